@@ -0,0 +1,442 @@
+package confluence
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dht/v2"
+	"github.com/anacrolix/dht/v2/bep44"
+	"github.com/anacrolix/dht/v2/exts/getput"
+	"github.com/anacrolix/dht/v2/krpc"
+	"github.com/anacrolix/dht/v2/traversal"
+	g "github.com/anacrolix/generics"
+	"github.com/anacrolix/log"
+	"github.com/anacrolix/torrent/bencode"
+)
+
+// The result of putting a BEP 44 item with one of the Handler's DHT servers.
+type bep44PutResult struct {
+	Server string `json:"server"`
+	// The sequence number put, for mutable items.
+	Seq int64 `json:"seq,omitempty"`
+	// The highest sequence number for the item found in the DHT before the put.
+	DhtSeq        int64  `json:"dhtSeq,omitempty"`
+	NodesTried    uint32 `json:"nodesTried"`
+	NodeResponses uint32 `json:"nodeResponses"`
+	Error         string `json:"error,omitempty"`
+}
+
+// The most a BEP 44 item's bencoded value can be.
+const bep44MaxValueLength = 1000
+
+// Parses the item for a BEP 44 put from the request. The body is the bencoded value. For mutable
+// items, the query has either "k", "sig" and "seq" for an item signed by the client, or "key" to
+// have it signed with one of Handler.Bep44Keys. In the latter case, "seq" is optional, and
+// otherwise follows what's found in the DHT. "salt" and "cas" are optional.
+func (h *Handler) bep44PutFromRequest(r *http.Request) (put bep44.Put, signer ed25519.PrivateKey, autoSeq bool, err error) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		err = fmt.Errorf("reading body: %w", err)
+		return
+	}
+	var v bencode.Bytes
+	err = bencode.Unmarshal(b, &v)
+	if err != nil {
+		err = fmt.Errorf("unmarshalling value: %w", err)
+		return
+	}
+	put.V = v
+	q := r.URL.Query()
+	put.Salt = []byte(q.Get("salt"))
+	if s := q.Get("cas"); s != "" {
+		put.Cas, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("parsing cas: %w", err)
+			return
+		}
+	}
+	if s := q.Get("seq"); s != "" {
+		put.Seq, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("parsing seq: %w", err)
+			return
+		}
+	}
+	if name := q.Get("key"); name != "" {
+		var ok bool
+		signer, ok = h.Bep44Keys[name]
+		if !ok {
+			err = fmt.Errorf("unknown key %q", name)
+			return
+		}
+		var k [32]byte
+		copy(k[:], signer.Public().(ed25519.PublicKey))
+		put.K = &k
+		autoSeq = q.Get("seq") == ""
+		put.Sign(signer)
+	} else if s := q.Get("k"); s != "" {
+		var k [32]byte
+		err = decodeHexArray(k[:], s)
+		if err != nil {
+			err = fmt.Errorf("parsing k: %w", err)
+			return
+		}
+		put.K = &k
+		err = decodeHexArray(put.Sig[:], q.Get("sig"))
+		if err != nil {
+			err = fmt.Errorf("parsing sig: %w", err)
+			return
+		}
+		if q.Get("seq") == "" {
+			err = fmt.Errorf("seq is required for signed items")
+			return
+		}
+	}
+	err = bep44.Check(put.ToItem())
+	return
+}
+
+func decodeHexArray(dst []byte, s string) error {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(b) != len(dst) {
+		return fmt.Errorf("expected %v bytes, got %v", len(dst), len(b))
+	}
+	copy(dst, b)
+	return nil
+}
+
+// Puts a BEP 44 item with all the DHT servers, and responds with the result for each.
+func (h *Handler) bep44PutHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, bep44MaxValueLength)
+	put, signer, autoSeq, err := h.bep44PutFromRequest(r)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		httpError(w, r, http.StatusRequestEntityTooLarge, ErrorCodeTooLarge,
+			fmt.Sprintf("value is longer than %v bytes", bep44MaxValueLength))
+		return
+	}
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	if len(h.DhtServers) == 0 {
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeNoDhtServers, "no dht servers")
+		return
+	}
+	target := put.Target()
+	h.forgetBep44Item(target)
+	h.forgetMutableTorrent(target)
+	results := make([]bep44PutResult, len(h.DhtServers))
+	var (
+		wg sync.WaitGroup
+		// The seq given to the item when it's chosen by the server, shared by all the DHT servers.
+		autoSeqMu sync.Mutex
+		seq       int64
+	)
+	for i, s := range h.DhtServers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := &results[i]
+			res.Server = s.String()
+			stats, err := getput.Put(r.Context(), target, s, put.Salt, func(dhtSeq int64) bep44.Put {
+				res.DhtSeq = dhtSeq
+				put := put
+				if !put.IsMutable() {
+					return put
+				}
+				if autoSeq {
+					autoSeqMu.Lock()
+					// The DHT may already have the item at the seq chosen for it from another
+					// server's put.
+					if seq == 0 || dhtSeq > seq {
+						seq = dhtSeq + 1
+					}
+					put.Seq = seq
+					autoSeqMu.Unlock()
+					put.Sign(signer)
+				}
+				res.Seq = put.Seq
+				switch {
+				// Nodes accept an item again at the seq they have, as when another of the
+				// Handler's servers put it first, regardless of cas.
+				case put.Cas != 0 && put.Cas != dhtSeq && put.Seq != dhtSeq:
+					res.Error = fmt.Sprintf("cas %v doesn't match seq %v in the dht", put.Cas, dhtSeq)
+				case put.Seq < dhtSeq:
+					res.Error = fmt.Sprintf("seq %v is older than seq %v in the dht", put.Seq, dhtSeq)
+				}
+				return put
+			})
+			if err != nil {
+				res.Error = err.Error()
+			}
+			if stats != nil {
+				res.NodesTried = stats.NumAddrsTried
+				res.NodeResponses = stats.NumResponses
+			}
+		}()
+	}
+	wg.Wait()
+	w.Header().Set("Content-Type", jsonContentType)
+	json.NewEncoder(w).Encode(struct {
+		Target  string           `json:"target"`
+		Results []bep44PutResult `json:"results"`
+	}{
+		Target:  hex.EncodeToString(target[:]),
+		Results: results,
+	})
+}
+
+// A BEP 44 item as found in the DHT. Mutable items have been verified against their signature.
+type bep44Item struct {
+	V       bencode.Bytes
+	Mutable bool
+	Seq     int64
+	K       [32]byte
+	Sig     [64]byte
+	Salt    []byte
+}
+
+// Whether the item supersedes other, for items with the same target.
+func (me bep44Item) newerThan(other bep44Item) bool {
+	return me.Mutable && me.Seq > other.Seq
+}
+
+// Returns the item if the reply to a get contains it.
+func bep44ItemFromReply(r *krpc.Return, target bep44.Target, salt []byte) (ret bep44Item, ok bool) {
+	if r.V == nil {
+		return
+	}
+	if sha1.Sum(r.V) == target {
+		return bep44Item{V: r.V}, true
+	}
+	if r.Seq == nil || bep44.MakeMutableTarget(r.K, salt) != target || !bep44.Verify(r.K[:], salt, *r.Seq, r.V, r.Sig[:]) {
+		return
+	}
+	ret.V = r.V
+	ret.Mutable = true
+	ret.Seq = *r.Seq
+	ret.K = r.K
+	ret.Sig = r.Sig
+	ret.Salt = salt
+	return ret, true
+}
+
+// Gets an item from the DHT with a single server. Unlike getput.Get, the key and signature of
+// mutable items are kept. The traversal completes early for immutable items, and otherwise returns
+// the highest sequence number found before it stalls or ctx is done.
+func bep44GetWithServer(ctx context.Context, s *dht.Server, target bep44.Target, salt []byte) (ret bep44Item, err error) {
+	var mu sync.Mutex
+	found := false
+	immutable := make(chan struct{})
+	op := traversal.Start(traversal.OperationInput{
+		Alpha:  15,
+		Target: target,
+		DoQuery: func(ctx context.Context, addr krpc.NodeAddr) traversal.QueryResult {
+			res := s.Get(ctx, dht.NewAddr(addr.UDP()), target, nil, dht.QueryRateLimiting{})
+			if r := res.Reply.R; r != nil {
+				if item, ok := bep44ItemFromReply(r, target, salt); ok {
+					mu.Lock()
+					if !found || item.newerThan(ret) {
+						if !found && !item.Mutable {
+							close(immutable)
+						}
+						found = true
+						ret = item
+					}
+					mu.Unlock()
+				}
+			}
+			tqr := res.TraversalQueryResult(addr)
+			// Only nodes that give a token are considered for the closest, as in getput.
+			tqr.ClosestData, _ = tqr.ClosestData.(string)
+			if tqr.ClosestData == nil {
+				tqr.ResponseFrom = nil
+			}
+			return tqr
+		},
+		NodeFilter: s.TraversalNodeFilter,
+	})
+	defer op.Stop()
+	nodes, err := s.TraversalStartingNodes()
+	if err != nil {
+		return
+	}
+	op.AddNodes(nodes)
+	select {
+	case <-op.Stalled():
+	case <-immutable:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if found {
+		err = nil
+	} else if err == nil {
+		err = errors.New("item not found")
+	}
+	return
+}
+
+type bep44CacheEntry struct {
+	item    bep44Item
+	expires time.Time
+	// The item was the newest from all DHT servers.
+	all bool
+}
+
+func (h *Handler) cachedBep44Item(target bep44.Target, salt []byte, all bool) (item bep44Item, ok bool) {
+	h.bep44CacheMu.Lock()
+	defer h.bep44CacheMu.Unlock()
+	e, ok := h.bep44Cache[target]
+	if !ok || time.Now().After(e.expires) || (all && !e.all) || (e.item.Mutable && !bytes.Equal(e.item.Salt, salt)) {
+		return item, false
+	}
+	return e.item, true
+}
+
+func (h *Handler) cacheBep44Item(target bep44.Target, item bep44Item, all bool) {
+	if h.Bep44CacheDuration <= 0 {
+		return
+	}
+	h.bep44CacheMu.Lock()
+	defer h.bep44CacheMu.Unlock()
+	now := time.Now()
+	for t, e := range h.bep44Cache {
+		if now.After(e.expires) {
+			delete(h.bep44Cache, t)
+		}
+	}
+	if h.bep44Cache == nil {
+		h.bep44Cache = make(map[bep44.Target]bep44CacheEntry)
+	}
+	h.bep44Cache[target] = bep44CacheEntry{item, now.Add(h.Bep44CacheDuration), all}
+}
+
+func (h *Handler) forgetBep44Item(target bep44.Target) {
+	h.bep44CacheMu.Lock()
+	defer h.bep44CacheMu.Unlock()
+	delete(h.bep44Cache, target)
+}
+
+// Gets the item from the DHT with each server. The first item found is returned, unless all is
+// set, in which case the newest item from all the servers is returned.
+func (h *Handler) bep44Get(ctx context.Context, target bep44.Target, salt []byte, all bool) (ret bep44Item, ok bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan g.Option[bep44Item], len(h.DhtServers))
+	for _, s := range h.DhtServers {
+		go func() {
+			item, err := bep44GetWithServer(ctx, s, target, salt)
+			if err != nil {
+				h.Logger.Levelf(log.Debug, "error getting %x from %v: %v", target, s, err)
+				results <- g.None[bep44Item]()
+				return
+			}
+			results <- g.Some(item)
+		}()
+	}
+	for range h.DhtServers {
+		res := <-results
+		if !res.Ok {
+			continue
+		}
+		if !ok || res.Value.newerThan(ret) {
+			ret = res.Value
+			ok = true
+		}
+		if !all {
+			break
+		}
+	}
+	return
+}
+
+// Gets an item from the DHT. The response is the bencoded value, unless the item is requested as
+// JSON with Accept, or bencoded with the "item" parameter, which include the sequence number, key,
+// signature and salt of mutable items.
+func (h *Handler) handleBep44(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var target bep44.Target
+	err := decodeHexArray(target[:], q.Get("target"))
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("parsing target: %v", err))
+		return
+	}
+	salt := []byte(q.Get("salt"))
+	all, _ := strconv.ParseBool(q.Get("all"))
+	ctx, cancel, err := timeoutParamContext(r)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	defer cancel()
+	if len(h.DhtServers) == 0 {
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeNoDhtServers, "no dht servers")
+		return
+	}
+	item, ok := h.cachedBep44Item(target, salt, all)
+	if !ok {
+		item, ok = h.bep44Get(ctx, target, salt, all)
+		if !ok {
+			httpError(w, r, http.StatusNotFound, ErrorCodeNotFound, "not found")
+			return
+		}
+		h.cacheBep44Item(target, item, all)
+	}
+	wantItem, _ := strconv.ParseBool(q.Get("item"))
+	switch {
+	case acceptsJson(r):
+		ret := struct {
+			Target string `json:"target"`
+			V      []byte `json:"v"`
+			Seq    *int64 `json:"seq,omitempty"`
+			K      string `json:"k,omitempty"`
+			Sig    string `json:"sig,omitempty"`
+			Salt   string `json:"salt,omitempty"`
+		}{
+			Target: hex.EncodeToString(target[:]),
+			V:      item.V,
+		}
+		if item.Mutable {
+			ret.Seq = &item.Seq
+			ret.K = hex.EncodeToString(item.K[:])
+			ret.Sig = hex.EncodeToString(item.Sig[:])
+			// Salts are arbitrary bytes, which JSON strings can't hold.
+			ret.Salt = hex.EncodeToString(item.Salt)
+		}
+		w.Header().Set("Content-Type", jsonContentType)
+		json.NewEncoder(w).Encode(ret)
+	case wantItem:
+		// The fields as they appear in BEP 44 messages.
+		ret := map[string]any{"v": item.V}
+		if item.Mutable {
+			ret["seq"] = item.Seq
+			ret["k"] = item.K[:]
+			ret["sig"] = item.Sig[:]
+			if len(item.Salt) != 0 {
+				ret["salt"] = item.Salt
+			}
+		}
+		w.Header().Set("Content-Type", bencodeContentType)
+		bencode.NewEncoder(w).Encode(ret)
+	default:
+		w.Header().Set("Content-Type", bencodeContentType)
+		w.Write(item.V)
+	}
+}
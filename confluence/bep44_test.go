@@ -0,0 +1,266 @@
+package confluence
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/dht/v2"
+	"github.com/anacrolix/dht/v2/bep44"
+	"github.com/anacrolix/dht/v2/krpc"
+	peer_store "github.com/anacrolix/dht/v2/peer-store"
+	"github.com/anacrolix/log"
+	"github.com/anacrolix/torrent/bencode"
+	"golang.org/x/time/rate"
+)
+
+// InMemory.GetPeers in this version of anacrolix/dht decodes peers from the wrong key, so nodes
+// would reply to get_peers with garbage.
+type testingPeerStore struct {
+	peer_store.InMemory
+}
+
+func (me *testingPeerStore) GetPeers(ih peer_store.InfoHash) (ret []krpc.NodeAddr) {
+	for _, nat := range me.GetAll()[ih] {
+		ret = append(ret, nat.NodeAddr)
+	}
+	return
+}
+
+// Returns DHT servers on localhost that only know about each other.
+func testingDhtServers(t *testing.T, n int) []*dht.Server {
+	conns := make([]net.PacketConn, n)
+	for i := range conns {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = conn
+	}
+	servers := make([]*dht.Server, n)
+	for i, conn := range conns {
+		cfg := dht.NewDefaultServerConfig()
+		cfg.Conn = conn
+		cfg.Logger = log.Default.WithNames(t.Name()).FilterLevel(log.Critical)
+		// The default is shared by all servers, and low enough to drop packets in tests.
+		cfg.SendLimiter = rate.NewLimiter(rate.Inf, 0)
+		cfg.PeerStore = &testingPeerStore{}
+		cfg.StartingNodes = func() (addrs []dht.Addr, err error) {
+			for _, other := range conns {
+				if other != conn {
+					addrs = append(addrs, dht.NewAddr(other.LocalAddr()))
+				}
+			}
+			return
+		}
+		s, err := dht.NewServer(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(s.Close)
+		servers[i] = s
+	}
+	return servers
+}
+
+type testBep44PutResponse struct {
+	Target  string           `json:"target"`
+	Results []bep44PutResult `json:"results"`
+}
+
+func testBep44Put(t *testing.T, h http.Handler, query url.Values, value any) testBep44PutResponse {
+	ret := testJsonRequest[testBep44PutResponse](t, h, httptest.NewRequest(
+		http.MethodPost,
+		"/bep44?"+query.Encode(),
+		strings.NewReader(string(bencode.MustMarshal(value)))), http.StatusOK)
+	for _, res := range ret.Results {
+		if res.Error != "" {
+			t.Fatalf("put result: %+v", res)
+		}
+	}
+	return ret
+}
+
+func testBep44Get(t *testing.T, h http.Handler, target, salt string) string {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(
+		http.MethodGet,
+		"/bep44?"+url.Values{"target": {target}, "salt": {salt}}.Encode(),
+		nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("get: %v %q", w.Code, w.Body.String())
+	}
+	return w.Body.String()
+}
+
+// Puts items through one Handler, and gets them through another, over a local DHT.
+func TestBep44Put(t *testing.T) {
+	servers := testingDhtServers(t, 4)
+	putter := &Handler{DhtServers: servers[:2]}
+	getter := &Handler{DhtServers: servers[3:]}
+
+	res := testBep44Put(t, putter, nil, "immutable")
+	if len(res.Results) != 2 {
+		t.Fatalf("results: %+v", res.Results)
+	}
+	if got := testBep44Get(t, getter, res.Target, ""); got != "9:immutable" {
+		t.Fatalf("immutable: %q", got)
+	}
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putter.Bep44Keys = map[string]ed25519.PrivateKey{"test": key}
+	query := url.Values{"key": {"test"}, "salt": {"salt"}}
+	res = testBep44Put(t, putter, query, "first")
+	testBep44Put(t, putter, query, "second")
+	if got := testBep44Get(t, getter, res.Target, "salt"); got != "6:second" {
+		t.Fatalf("server signed: %q", got)
+	}
+
+	// Sign as a client would, following on from the server signed items.
+	seq := int64(3)
+	sig := bep44.Sign(key, []byte("salt"), seq, bencode.MustMarshal("third"))
+	testBep44Put(t, putter, url.Values{
+		"k":    {hex.EncodeToString(key.Public().(ed25519.PublicKey))},
+		"sig":  {hex.EncodeToString(sig)},
+		"seq":  {strconv.FormatInt(seq, 10)},
+		"cas":  {"2"},
+		"salt": {"salt"},
+	}, "third")
+	if got := testBep44Get(t, getter, res.Target, "salt"); got != "5:third" {
+		t.Fatalf("client signed: %q", got)
+	}
+
+	w := httptest.NewRecorder()
+	query.Set("cas", "2")
+	putter.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/bep44?"+query.Encode(), strings.NewReader("6:fourth")))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "cas 2 doesn't match seq 3") {
+		t.Fatalf("stale cas: %v %q", w.Code, w.Body.String())
+	}
+}
+
+func TestBep44PutBadRequest(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{
+		DhtServers: testingDhtServers(t, 1),
+		Bep44Keys:  map[string]ed25519.PrivateKey{"test": key},
+	}
+	for _, query := range []url.Values{
+		{"key": {"unknown"}},
+		{"k": {hex.EncodeToString(key.Public().(ed25519.PublicKey))}, "sig": {strings.Repeat("00", 64)}, "seq": {"1"}},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/bep44?"+query.Encode(), strings.NewReader("1:v")))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: %v", query, w.Code)
+		}
+	}
+	// Values too long for BEP 44 are refused as such, rather than truncated.
+	value, err := bencode.Marshal(strings.Repeat("v", bep44MaxValueLength-3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(value) != bep44MaxValueLength+1 {
+		t.Fatal(len(value))
+	}
+	r := httptest.NewRequest(http.MethodPost, "/bep44", bytes.NewReader(value))
+	r.Header.Set("Accept", jsonContentType)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var e Error
+	json.Unmarshal(w.Body.Bytes(), &e)
+	if w.Code != http.StatusRequestEntityTooLarge || e.Code != ErrorCodeTooLarge {
+		t.Fatalf("%v %q", w.Code, w.Body.String())
+	}
+}
+
+// Gets the newest item from separate DHTs, with its metadata, and caches it.
+func TestBep44GetAll(t *testing.T) {
+	dhtA := testingDhtServers(t, 2)
+	dhtB := testingDhtServers(t, 2)
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]ed25519.PrivateKey{"test": key}
+	putSeq := func(h http.Handler, seq int, value string) testBep44PutResponse {
+		return testBep44Put(t, h, url.Values{"key": {"test"}, "salt": {"salt"}, "seq": {strconv.Itoa(seq)}}, value)
+	}
+	target := putSeq(&Handler{DhtServers: dhtA[:1], Bep44Keys: keys}, 1, "old").Target
+	putterB := &Handler{DhtServers: dhtB[:1], Bep44Keys: keys}
+	putSeq(putterB, 5, "new")
+	getter := &Handler{
+		DhtServers:         []*dht.Server{dhtA[1], dhtB[1]},
+		Bep44Keys:          keys,
+		Bep44CacheDuration: time.Minute,
+	}
+	getItem := func() (ret struct {
+		V    []byte `json:"v"`
+		Seq  int64  `json:"seq"`
+		K    string `json:"k"`
+		Sig  string `json:"sig"`
+		Salt string `json:"salt"`
+	}) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/bep44?"+url.Values{
+			"target": {target}, "salt": {"salt"}, "all": {"1"}, "timeout": {"10s"},
+		}.Encode(), nil)
+		r.Header.Set("Accept", jsonContentType)
+		getter.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("get: %v %q", w.Code, w.Body.String())
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &ret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	item := getItem()
+	if string(item.V) != "3:new" || item.Seq != 5 || item.K != hex.EncodeToString(key.Public().(ed25519.PublicKey)) ||
+		item.Salt != hex.EncodeToString([]byte("salt")) {
+		t.Fatalf("item: %+v", item)
+	}
+	sig, _ := hex.DecodeString(item.Sig)
+	if !bep44.Verify(key.Public().(ed25519.PublicKey), []byte("salt"), item.Seq, item.V, sig) {
+		t.Fatal("bad signature")
+	}
+
+	// Puts through other Handlers aren't seen until the cached item expires.
+	putSeq(putterB, 6, "newer")
+	if item := getItem(); item.Seq != 5 {
+		t.Fatalf("cached item: %+v", item)
+	}
+	putSeq(getter, 7, "newest")
+	if item := getItem(); item.Seq != 7 {
+		t.Fatalf("item after put: %+v", item)
+	}
+
+	w := httptest.NewRecorder()
+	getter.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/bep44?"+url.Values{
+		"target": {target}, "salt": {"salt"}, "item": {"1"},
+	}.Encode(), nil))
+	var bencoded struct {
+		V   bencode.Bytes `bencode:"v"`
+		Seq int64         `bencode:"seq"`
+		K   []byte        `bencode:"k"`
+	}
+	err = bencode.Unmarshal(w.Body.Bytes(), &bencoded)
+	if err != nil || bencoded.Seq != 7 || string(bencoded.V) != "6:newest" {
+		t.Fatalf("bencoded item: %v %+v", err, bencoded)
+	}
+}
@@ -0,0 +1,139 @@
+package confluence
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/dht/v2/bep44"
+	g "github.com/anacrolix/generics"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	infohash_v2 "github.com/anacrolix/torrent/types/infohash-v2"
+)
+
+// A mutable torrent (BEP 46), identified by the public key and salt of the DHT item that holds its
+// current infohash.
+type MutableTorrent struct {
+	PublicKey [32]byte
+	Salt      []byte
+}
+
+const btpkPrefix = "urn:btpk:"
+
+func (me MutableTorrent) target() bep44.Target {
+	return bep44.MakeMutableTarget(me.PublicKey, me.Salt)
+}
+
+// Returns the mutable torrent given by the "xs=urn:btpk:" and "s" parameters of a magnet link, both
+// in hex, if present.
+func magnetMutableTorrent(params url.Values) (ret *MutableTorrent, err error) {
+	for _, xs := range params["xs"] {
+		pk, ok := strings.CutPrefix(xs, btpkPrefix)
+		if !ok {
+			continue
+		}
+		ret = new(MutableTorrent)
+		err = decodeHexArray(ret.PublicKey[:], pk)
+		if err != nil {
+			err = fmt.Errorf("parsing public key: %w", err)
+			return
+		}
+		ret.Salt, err = hex.DecodeString(params.Get("s"))
+		if err != nil {
+			err = fmt.Errorf("parsing salt: %w", err)
+		}
+		return
+	}
+	return
+}
+
+const defaultMutableTorrentCacheDuration = time.Minute
+
+type mutableTorrentCacheEntry struct {
+	v1      metainfo.Hash
+	v2      g.Option[infohash_v2.T]
+	expires time.Time
+}
+
+func (h *Handler) mutableTorrentCacheDuration() time.Duration {
+	if h.MutableTorrentCacheDuration == 0 {
+		return defaultMutableTorrentCacheDuration
+	}
+	return h.MutableTorrentCacheDuration
+}
+
+func (h *Handler) cachedMutableTorrent(target bep44.Target) (e mutableTorrentCacheEntry, ok bool) {
+	h.bep44CacheMu.Lock()
+	defer h.bep44CacheMu.Unlock()
+	e, ok = h.mutableTorrentCache[target]
+	return e, ok && time.Now().Before(e.expires)
+}
+
+func (h *Handler) cacheMutableTorrent(target bep44.Target, v1 metainfo.Hash, v2 g.Option[infohash_v2.T]) {
+	if h.mutableTorrentCacheDuration() < 0 {
+		return
+	}
+	h.bep44CacheMu.Lock()
+	defer h.bep44CacheMu.Unlock()
+	now := time.Now()
+	for t, e := range h.mutableTorrentCache {
+		if now.After(e.expires) {
+			delete(h.mutableTorrentCache, t)
+		}
+	}
+	if h.mutableTorrentCache == nil {
+		h.mutableTorrentCache = make(map[bep44.Target]mutableTorrentCacheEntry)
+	}
+	h.mutableTorrentCache[target] = mutableTorrentCacheEntry{v1, v2, now.Add(h.mutableTorrentCacheDuration())}
+}
+
+func (h *Handler) forgetMutableTorrent(target bep44.Target) {
+	h.bep44CacheMu.Lock()
+	defer h.bep44CacheMu.Unlock()
+	delete(h.mutableTorrentCache, target)
+}
+
+// Looks up the current infohash of a mutable torrent in the DHT. The newest item from all the DHT
+// servers is used. The infohash is cached for Handler.MutableTorrentCacheDuration, and the item
+// like other BEP 44 gets.
+func (h *Handler) resolveMutableTorrent(ctx context.Context, mt MutableTorrent) (
+	v1 metainfo.Hash, v2 g.Option[infohash_v2.T], status int, err *Error,
+) {
+	target := mt.target()
+	if e, ok := h.cachedMutableTorrent(target); ok {
+		return e.v1, e.v2, 0, nil
+	}
+	if len(h.DhtServers) == 0 {
+		return v1, v2, http.StatusInternalServerError, newError(ErrorCodeNoDhtServers, "no dht servers")
+	}
+	item, ok := h.cachedBep44Item(target, mt.Salt, true)
+	if !ok {
+		item, ok = h.bep44Get(ctx, target, mt.Salt, true)
+		if !ok {
+			return v1, v2, http.StatusNotFound, newError(ErrorCodeNotFound, "mutable torrent not found in dht")
+		}
+		h.cacheBep44Item(target, item, true)
+	}
+	var value struct {
+		Ih []byte `bencode:"ih"`
+	}
+	unmarshalErr := bencode.Unmarshal(item.V, &value)
+	switch {
+	case unmarshalErr != nil:
+	case len(value.Ih) == len(v1):
+		copy(v1[:], value.Ih)
+		h.cacheMutableTorrent(target, v1, v2)
+		return
+	case len(value.Ih) == len(v2.Value):
+		copy(v2.Value[:], value.Ih)
+		v2.Ok = true
+		h.cacheMutableTorrent(target, v1, v2)
+		return
+	}
+	return v1, v2, http.StatusBadGateway, newError(ErrorCodeBadInfohash, fmt.Sprintf("mutable torrent item has no infohash: %q", item.V))
+}
@@ -0,0 +1,77 @@
+package confluence
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func putMutableTorrent(t *testing.T, h http.Handler, salt string, ih metainfo.Hash) {
+	testBep44Put(t, h, url.Values{"key": {"test"}, "salt": {salt}}, map[string]any{"ih": ih.Bytes()})
+}
+
+func mutableTorrentDataRequest(key ed25519.PrivateKey, salt, path string) *http.Request {
+	magnet := "magnet:?xs=urn:btpk:" + hex.EncodeToString(key.Public().(ed25519.PublicKey)) +
+		"&s=" + hex.EncodeToString([]byte(salt))
+	r := magnetRequest("/data", magnet)
+	r.URL.RawQuery += "&path=" + path
+	return r
+}
+
+// Serves data for a mutable torrent as it's updated.
+func TestMutableTorrent(t *testing.T) {
+	servers := testingDhtServers(t, 2)
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher := &Handler{
+		DhtServers: servers[1:],
+		Bep44Keys:  map[string]ed25519.PrivateKey{"test": key},
+	}
+	h := testingHandler(t)
+	h.DhtServers = servers[:1]
+	// Each update is seen.
+	h.MutableTorrentCacheDuration = -1
+	for _, data := range []string{"first", "second"} {
+		// File storage is by torrent name.
+		ih := testUpload(t, h, data, map[string]string{"a": data})
+		putMutableTorrent(t, publisher, "salt", ih)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, mutableTorrentDataRequest(key, "salt", "a"))
+		if w.Code != http.StatusOK || w.Body.String() != data {
+			t.Fatalf("%v: %v %q", data, w.Code, w.Body.String())
+		}
+	}
+
+	// The mapping is cached by default, even with BEP 44 gets uncached, so the DHT isn't used
+	// again. A DHT server that knows of nothing would fail the request.
+	h.MutableTorrentCacheDuration = 0
+	h.ServeHTTP(httptest.NewRecorder(), mutableTorrentDataRequest(key, "salt", "a"))
+	putMutableTorrent(t, publisher, "salt", testUpload(t, h, "third", map[string]string{"a": "third"}))
+	h.DhtServers = testingDhtServers(t, 1)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, mutableTorrentDataRequest(key, "salt", "a"))
+	if w.Code != http.StatusOK || w.Body.String() != "second" {
+		t.Fatalf("cached: %v %q", w.Code, w.Body.String())
+	}
+	h.DhtServers = servers[:1]
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, mutableTorrentDataRequest(key, "other salt", "a"))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown salt: %v %q", w.Code, w.Body.String())
+	}
+	testBep44Put(t, publisher, url.Values{"key": {"test"}, "salt": {"bad"}}, bencode.Bytes("2:hi"))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, mutableTorrentDataRequest(key, "bad", "a"))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("bad item: %v %q", w.Code, w.Body.String())
+	}
+}
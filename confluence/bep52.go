@@ -0,0 +1,316 @@
+package confluence
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+
+	g "github.com/anacrolix/generics"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/merkle"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Values for the "version" field of an upload.
+const (
+	uploadVersionV1     = "1"
+	uploadVersionV2     = "2"
+	uploadVersionHybrid = "hybrid"
+)
+
+// Sorts the files of an upload into the order files appear in a v2 file tree, which is also the
+// order they're stored in. Paths must be unique, and not both files and directories. others holds
+// something per file, and is sorted along with them.
+func sortFileTreeOrder[T any](files []metainfo.FileInfo, others []T) error {
+	order := make([]int, len(files))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		return slices.Compare(files[a].Path, files[b].Path)
+	})
+	sortedFiles := make([]metainfo.FileInfo, 0, len(files))
+	sortedOthers := make([]T, 0, len(others))
+	for i, j := range order {
+		if i > 0 {
+			prev := sortedFiles[i-1].Path
+			cur := files[j].Path
+			if len(prev) <= len(cur) && slices.Equal(prev, cur[:len(prev)]) {
+				return fmt.Errorf("conflicting file paths %q and %q", prev, cur)
+			}
+		}
+		sortedFiles = append(sortedFiles, files[j])
+		sortedOthers = append(sortedOthers, others[j])
+	}
+	copy(files, sortedFiles)
+	copy(others, sortedOthers)
+	return nil
+}
+
+// Sets the v2 fields of info from the hashes of its files (BEP 52), and the v1 fields if they were
+// hashed for a hybrid torrent. Files must be in file tree order, see sortFileTreeOrder. In hybrid
+// torrents, padding files are inserted in the v1 file list so that each file starts on a piece
+// boundary. Returns the piece layers for the metainfo.
+func setV2Info(info *metainfo.Info, files []metainfo.FileInfo, hashers []*v2FileHasher) (pieceLayers map[string]string) {
+	pieceLayers = make(map[string]string)
+	treeFiles := make([]metainfo.FileTreeFile, 0, len(files))
+	var (
+		hybrid   bool
+		v1Pieces []byte
+	)
+	for i, hasher := range hashers {
+		treeFiles = append(treeFiles, hasher.fileTreeFile(pieceLayers))
+		if hasher.v1 != nil {
+			hybrid = true
+			v1Pieces = append(v1Pieces, hasher.v1.finish(i != len(hashers)-1)...)
+		}
+	}
+	setV2FileTree(info, files, treeFiles, hybrid)
+	info.Pieces = v1Pieces
+	return
+}
+
+// Sets the v2 file tree of info from the files' entries, and the v1 file list if hybrid, but not
+// the v1 pieces. See setV2Info.
+func setV2FileTree(info *metainfo.Info, files []metainfo.FileInfo, treeFiles []metainfo.FileTreeFile, hybrid bool) {
+	info.MetaVersion = 2
+	info.FileTree = metainfo.FileTree{}
+	info.Files = nil
+	info.Pieces = nil
+	for i, fi := range files {
+		fileTreeInsert(&info.FileTree, fi.Path, treeFiles[i])
+		if !hybrid {
+			continue
+		}
+		last := i == len(files)-1
+		info.Files = append(info.Files, fi)
+		pad := (info.PieceLength - fi.Length%info.PieceLength) % info.PieceLength
+		if pad == 0 || last {
+			continue
+		}
+		info.Files = append(info.Files, metainfo.FileInfo{
+			Length:            pad,
+			Path:              []string{".pad", strconv.FormatInt(pad, 10)},
+			ExtendedFileAttrs: metainfo.ExtendedFileAttrs{Attr: "p"},
+		})
+	}
+}
+
+// Computes the pieces root and piece layer of a file in a v2 torrent as it's written, without
+// holding more than the piece hashes.
+type v2FileHasher struct {
+	pieceLength  int64
+	length       int64
+	pieceHash    *merkle.Hash
+	pieceWritten int64
+	layer        [][32]byte
+	// Hashes the file as v1 pieces in a hybrid torrent, where files start on piece boundaries. Nil
+	// if the torrent isn't hybrid.
+	v1 *v1PieceHasher
+}
+
+func newV2FileHasher(pieceLength int64, hybrid bool) *v2FileHasher {
+	ret := &v2FileHasher{
+		pieceLength: pieceLength,
+		pieceHash:   merkle.NewHash(),
+	}
+	if hybrid {
+		ret.v1 = newV1PieceHasher(pieceLength)
+	}
+	return ret
+}
+
+func (me *v2FileHasher) Write(b []byte) (n int, err error) {
+	if me.v1 != nil {
+		me.v1.Write(b)
+	}
+	for len(b) > 0 {
+		// The last piece is only summed once it's known whether it's the only one.
+		if me.pieceWritten == me.pieceLength {
+			me.finishPiece()
+		}
+		n1 := int(min(int64(len(b)), me.pieceLength-me.pieceWritten))
+		me.pieceHash.Write(b[:n1])
+		me.pieceWritten += int64(n1)
+		b = b[n1:]
+		n += n1
+	}
+	me.length += int64(n)
+	return
+}
+
+func (me *v2FileHasher) finishPiece() {
+	var sum [32]byte
+	me.pieceHash.SumMinLength(sum[:0], int(me.pieceLength))
+	me.layer = append(me.layer, sum)
+	me.pieceHash.Reset()
+	me.pieceWritten = 0
+}
+
+// Returns the file's entry in the file tree once it's completely written, and adds its piece
+// layer if it has more than one piece.
+func (me *v2FileHasher) fileTreeFile(pieceLayers map[string]string) (ret metainfo.FileTreeFile) {
+	ret.Length = me.length
+	if me.length == 0 {
+		return
+	}
+	var root [32]byte
+	if len(me.layer) == 0 {
+		// The root of a file of a single piece isn't padded to the piece length.
+		me.pieceHash.Sum(root[:0])
+	} else {
+		me.finishPiece()
+		root = merkle.RootWithPadHash(me.layer, metainfo.HashForPiecePad(me.pieceLength))
+		var compact []byte
+		for _, h := range me.layer {
+			compact = append(compact, h[:]...)
+		}
+		pieceLayers[string(root[:])] = string(compact)
+	}
+	ret.PiecesRoot = string(root[:])
+	return
+}
+
+// Computes v1 piece hashes of data as it's written.
+type v1PieceHasher struct {
+	pieceLength  int64
+	pieceHash    hash.Hash
+	pieceWritten int64
+	pieces       []byte
+}
+
+func newV1PieceHasher(pieceLength int64) *v1PieceHasher {
+	return &v1PieceHasher{
+		pieceLength: pieceLength,
+		pieceHash:   sha1.New(),
+	}
+}
+
+func (me *v1PieceHasher) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		n1 := int(min(int64(len(b)), me.pieceLength-me.pieceWritten))
+		me.pieceHash.Write(b[:n1])
+		me.pieceWritten += int64(n1)
+		if me.pieceWritten == me.pieceLength {
+			me.pieces = me.pieceHash.Sum(me.pieces)
+			me.pieceHash.Reset()
+			me.pieceWritten = 0
+		}
+		b = b[n1:]
+		n += n1
+	}
+	return
+}
+
+// Returns the concatenated piece hashes once all the data is written. If pad is set, a short last
+// piece is hashed as if padded with zeroes to the piece length.
+func (me *v1PieceHasher) finish(pad bool) []byte {
+	if me.pieceWritten != 0 {
+		if pad {
+			io.CopyN(me.pieceHash, zeroReader{}, me.pieceLength-me.pieceWritten)
+		}
+		me.pieces = me.pieceHash.Sum(me.pieces)
+		me.pieceHash.Reset()
+		me.pieceWritten = 0
+	}
+	return me.pieces
+}
+
+// The hash storage expects for an uploaded piece, as the torrent Client would give it. Pieces of v2
+// torrents that are the only piece in a file use the pieces root of the file.
+func uploadPieceHash(p metainfo.Piece, data []byte) (ret g.Option[[]byte]) {
+	if v1 := p.V1Hash(); v1.Ok {
+		return g.Some(v1.Value.Bytes())
+	}
+	files := p.Info.UpvertedFiles()
+	i, ok := fileAtOffset(files, p.Offset())
+	if !ok {
+		return
+	}
+	return g.Some(v2PieceDataHash(p, files[i].Length, data))
+}
+
+// Returns the v2 hash of the data of a piece in a file of the given length. A file of one piece has
+// its pieces root as the hash, which isn't padded to the piece length.
+func v2PieceDataHash(p metainfo.Piece, fileLength int64, data []byte) []byte {
+	h := merkle.NewHash()
+	h.Write(data)
+	if fileLength > p.Info.PieceLength {
+		return h.SumMinLength(nil, int(p.Info.PieceLength))
+	}
+	return h.Sum(nil)
+}
+
+// Returns the index of the file containing the torrent offset, given files in torrent order.
+func fileAtOffset(files []metainfo.FileInfo, off int64) (int, bool) {
+	// File ends don't decrease, even with the padding between files in v2 torrents.
+	i := sort.Search(len(files), func(i int) bool {
+		return files[i].TorrentOffset+files[i].Length > off
+	})
+	return i, i < len(files) && files[i].TorrentOffset <= off
+}
+
+func fileTreeInsert(ft *metainfo.FileTree, path []string, file metainfo.FileTreeFile) {
+	if len(path) == 0 {
+		ft.File = file
+		return
+	}
+	if ft.Dir == nil {
+		ft.Dir = make(map[string]metainfo.FileTree)
+	}
+	sub := ft.Dir[path[0]]
+	fileTreeInsert(&sub, path[1:], file)
+	ft.Dir[path[0]] = sub
+}
+
+// Bencodes an info dictionary. metainfo.FileTree doesn't implement bencode.Marshaler, so v2 fields
+// are encoded here.
+func marshalInfo(info *metainfo.Info) ([]byte, error) {
+	if !info.HasV2() {
+		return bencode.Marshal(info)
+	}
+	v1 := *info
+	v1.MetaVersion = 0
+	v1.FileTree = metainfo.FileTree{}
+	b, err := bencode.Marshal(v1)
+	if err != nil {
+		return nil, err
+	}
+	var dict map[string]bencode.Bytes
+	err = bencode.Unmarshal(b, &dict)
+	if err != nil {
+		return nil, err
+	}
+	if len(info.Pieces) == 0 {
+		delete(dict, "pieces")
+	}
+	dict["meta version"] = bencode.MustMarshal(info.MetaVersion)
+	dict["file tree"] = bencode.MustMarshal(fileTreeBencodeValue(info.FileTree))
+	return bencode.Marshal(dict)
+}
+
+func fileTreeBencodeValue(ft metainfo.FileTree) map[string]any {
+	if !ft.IsDir() {
+		file := map[string]any{"length": ft.File.Length}
+		if ft.File.PiecesRoot != "" {
+			file["pieces root"] = ft.File.PiecesRoot
+		}
+		return map[string]any{metainfo.FileTreePropertiesKey: file}
+	}
+	ret := make(map[string]any, len(ft.Dir))
+	for name, sub := range ft.Dir {
+		ret[name] = fileTreeBencodeValue(sub)
+	}
+	return ret
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
@@ -0,0 +1,70 @@
+package confluence
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+	infohash_v2 "github.com/anacrolix/torrent/types/infohash-v2"
+)
+
+// Uploads v2 and hybrid torrents, and reads them back by each of their infohashes.
+func TestUploadV2(t *testing.T) {
+	files := map[string]string{
+		// Spans several of the minimum piece length, so has a piece layer.
+		"a":     strings.Repeat("hello", 10000),
+		"dir/b": "world",
+	}
+	for _, version := range []string{uploadVersionV2, uploadVersionHybrid} {
+		t.Run(version, func(t *testing.T) {
+			h := testingHandler(t)
+			mi := testUploadMetainfo(t, h, map[string]string{"name": "test", "version": version}, files)
+			info, err := mi.UnmarshalInfo()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !info.HasV2() || info.HasV1() != (version == uploadVersionHybrid) {
+				t.Fatalf("v1=%v v2=%v", info.HasV1(), info.HasV2())
+			}
+			err = metainfo.ValidatePieceLayers(mi.PieceLayers, &info.FileTree, info.PieceLength)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v2 := infohash_v2.HashBytes(mi.InfoBytes)
+			ihs := []string{v2.HexString()}
+			if info.HasV1() {
+				ihs = append(ihs, mi.HashInfoBytes().HexString())
+			}
+			for _, ih := range ihs {
+				for path, data := range files {
+					w := httptest.NewRecorder()
+					h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/data/infohash/"+ih+"/"+path, nil))
+					if w.Code != http.StatusOK || w.Body.String() != data {
+						t.Errorf("%v %v: got %v with %v bytes", ih, path, w.Code, w.Body.Len())
+					}
+				}
+			}
+			w := httptest.NewRecorder()
+			magnet := "magnet:?xt=urn:btmh:1220" + v2.HexString()
+			r := magnetRequest("/data", magnet)
+			r.URL.RawQuery += "&path=dir/b"
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusOK || w.Body.String() != files["dir/b"] {
+				t.Errorf("btmh magnet: got %v %q", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestUploadV2ConflictingPaths(t *testing.T) {
+	h := testingHandler(t)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newUploadRequest(
+		map[string]string{"name": "test", "version": uploadVersionV2},
+		map[string]string{"a": "x", "a/b": "y"}))
+	if w.Code != http.StatusBadRequest {
+		t.Fatal(w.Code)
+	}
+}
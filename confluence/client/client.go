@@ -0,0 +1,301 @@
+// Package client provides typed access to the HTTP API served by confluence.Handler.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"golang.org/x/net/websocket"
+
+	"github.com/anacrolix/confluence/confluence"
+)
+
+type Client struct {
+	// The base URL of the confluence instance, for example "http://localhost:8080".
+	Address string
+	// Used for all requests except the events websocket. Defaults to http.DefaultClient.
+	HttpClient *http.Client
+}
+
+// Returned when confluence responds with an unexpected status.
+type Error struct {
+	StatusCode int
+	// The structured error from the response. If confluence didn't respond with one, only the
+	// Message is set.
+	Body confluence.Error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("confluence responded with status %v: %v", e.StatusCode, e.Body.Message)
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HttpClient == nil {
+		return http.DefaultClient
+	}
+	return c.HttpClient
+}
+
+func (c *Client) url(path string, query url.Values) string {
+	u := strings.TrimSuffix(c.Address, "/") + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+func torrentQuery(ih metainfo.Hash) url.Values {
+	return url.Values{"ih": {ih.HexString()}}
+}
+
+// Asks for a metainfo, and for errors as JSON so they decode into an Error with its code.
+const metainfoAccept = "application/x-bittorrent, application/json;q=0.5"
+
+func (c *Client) newRequest(
+	ctx context.Context, method, path string, query url.Values, body io.Reader,
+) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path, query), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+// Performs the request, and returns an *Error if the response status isn't one of the expected
+// values.
+func (c *Client) do(req *http.Request, expectedStatuses ...int) (*http.Response, error) {
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range expectedStatuses {
+		if resp.StatusCode == s {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	return nil, responseError(resp)
+}
+
+func responseError(resp *http.Response) error {
+	e := &Error{StatusCode: resp.StatusCode}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading error response with status %v: %w", resp.StatusCode, err)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "application/json" || json.Unmarshal(b, &e.Body) != nil {
+		e.Body = confluence.Error{Message: strings.TrimSpace(string(b))}
+	}
+	return e
+}
+
+func (c *Client) get(ctx context.Context, path string, query url.Values) ([]byte, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, path, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// Returns the info for the torrent, waiting until confluence has it.
+func (c *Client) Info(ctx context.Context, ih metainfo.Hash) (info metainfo.Info, err error) {
+	b, err := c.get(ctx, "/info", torrentQuery(ih))
+	if err != nil {
+		return
+	}
+	err = bencode.Unmarshal(b, &info)
+	return
+}
+
+// Returns the metainfo confluence holds for the torrent, waiting until it has the info.
+func (c *Client) Metainfo(ctx context.Context, ih metainfo.Hash) (*metainfo.MetaInfo, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/metainfo", torrentQuery(ih), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", metainfoAccept)
+	resp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return metainfo.Load(resp.Body)
+}
+
+// Merges the metainfo into the torrent it describes, and returns that torrent's infohash.
+func (c *Client) PutMetainfo(ctx context.Context, mi *metainfo.MetaInfo) (ih metainfo.Hash, err error) {
+	var buf bytes.Buffer
+	err = mi.Write(&buf)
+	if err != nil {
+		return
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "/metainfo", nil, &buf)
+	if err != nil {
+		return
+	}
+	resp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	err = ih.FromHexString(strings.TrimSpace(string(b)))
+	return
+}
+
+// Returns the state of each piece of the file with the given display path.
+func (c *Client) FileState(
+	ctx context.Context, ih metainfo.Hash, path string,
+) (
+	ret []torrent.FilePieceState, err error,
+) {
+	q := torrentQuery(ih)
+	q.Set("path", path)
+	b, err := c.get(ctx, "/fileState", q)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &ret)
+	return
+}
+
+// A file to be included in an upload.
+type UploadFile struct {
+	// Slash-separated path of the file within the torrent.
+	Path string
+	Data io.Reader
+}
+
+// Creates a torrent with the given name from the files, and stores the data in confluence. Returns
+// the resulting metainfo.
+func (c *Client) Upload(
+	ctx context.Context, name string, files []UploadFile,
+) (
+	*metainfo.MetaInfo, error,
+) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeUploadForm(mw, name, files))
+	}()
+	defer pr.Close()
+	req, err := c.newRequest(ctx, http.MethodPost, "/upload", nil, pr)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", metainfoAccept)
+	resp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return metainfo.Load(resp.Body)
+}
+
+func writeUploadForm(mw *multipart.Writer, name string, files []UploadFile) error {
+	err := mw.WriteField("name", name)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		// multipart.Writer.CreateFormFile would do, but the upload handler uses the filename for
+		// the path within the torrent, so be explicit that it's not just a base name.
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{
+			"name":     "files",
+			"filename": f.Path,
+		}))
+		h.Set("Content-Type", "application/octet-stream")
+		pw, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(pw, f.Data)
+		if err != nil {
+			return fmt.Errorf("copying %q: %w", f.Path, err)
+		}
+	}
+	return mw.Close()
+}
+
+// Creates a torrent from a directory on the confluence host, which must be within one of its seed
+// directories, and seeds it in place. The options are the upload form fields, such as version.
+// Returns the resulting metainfo.
+func (c *Client) SeedDir(ctx context.Context, path string, options url.Values) (*metainfo.MetaInfo, error) {
+	form := url.Values{"path": {path}}
+	for k, vs := range options {
+		form[k] = append(form[k], vs...)
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "/admin/seedDir", nil, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", metainfoAccept)
+	resp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return metainfo.Load(resp.Body)
+}
+
+// Subscribes to events for the torrent. The channel is closed when the context is done, or the
+// connection to confluence is lost.
+func (c *Client) Events(ctx context.Context, ih metainfo.Hash) (<-chan confluence.Event, error) {
+	location := c.url("/events", torrentQuery(ih))
+	if after, ok := strings.CutPrefix(location, "http"); ok {
+		location = "ws" + after
+	}
+	cfg, err := websocket.NewConfig(location, c.Address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := cfg.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan confluence.Event)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	go func() {
+		defer close(events)
+		defer stop()
+		defer conn.Close()
+		for {
+			var e confluence.Event
+			err := websocket.JSON.Receive(conn, &e)
+			if err != nil {
+				return
+			}
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
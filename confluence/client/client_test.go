@@ -0,0 +1,229 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/confluence/confluence"
+	"github.com/anacrolix/confluence/confluence/internal/testutil"
+)
+
+func newTestHandler(t *testing.T) *confluence.Handler {
+	cl, metainfoStorage, storageClient := testutil.HandlerParts(t)
+	return &confluence.Handler{
+		TC:                       cl,
+		MetainfoStorageInterface: metainfoStorage,
+		Storage:                  storageClient,
+		UploadSpoolDir:           t.TempDir(),
+	}
+}
+
+func newTestClient(t *testing.T) *Client {
+	srv := httptest.NewServer(newTestHandler(t))
+	t.Cleanup(srv.Close)
+	return &Client{Address: srv.URL}
+}
+
+func TestUploadAndRead(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+	hello := []byte("hello, world\n")
+	big := bytes.Repeat([]byte("confluence"), 100000)
+	mi, err := c.Upload(ctx, "test", []UploadFile{
+		{Path: "hello.txt", Data: bytes.NewReader(hello)},
+		{Path: "dir/big", Data: bytes.NewReader(big)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ih := mi.HashInfoBytes()
+
+	info, err := c.Info(ctx, ih)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "test" || len(info.Files) != 2 {
+		t.Fatalf("unexpected info: %#v", info)
+	}
+	gotMi, err := c.Metainfo(ctx, ih)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotMi.HashInfoBytes() != ih {
+		t.Fatal("metainfo has wrong infohash")
+	}
+
+	r, err := c.Open(ctx, ih, "hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, hello) {
+		t.Fatalf("read %q", b)
+	}
+
+	r, err = c.Open(ctx, ih, "dir/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end != int64(len(big)) {
+		t.Fatalf("size %v", end)
+	}
+	const off = 123457
+	_, err = r.Seek(off, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = make([]byte, 20)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, big[off:off+len(b)]) {
+		t.Fatalf("read %q at %v", b, off)
+	}
+
+	r, err = c.Open(ctx, ih, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != len(hello)+len(big) {
+		t.Fatalf("read %v bytes of whole torrent", len(b))
+	}
+
+	states, err := c.FileState(ctx, ih, "hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) == 0 || !states[0].Complete {
+		t.Fatalf("unexpected file state: %#v", states)
+	}
+}
+
+func TestPutMetainfo(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+	mi, err := c.Upload(ctx, "test", []UploadFile{
+		{Path: "a", Data: strings.NewReader("a")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const tracker = "http://tracker.example/announce"
+	mi.AnnounceList = [][]string{{tracker}}
+	ih, err := c.PutMetainfo(ctx, mi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ih != mi.HashInfoBytes() {
+		t.Fatal(ih)
+	}
+	gotMi, err := c.Metainfo(ctx, ih)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.Join(gotMi.UpvertedAnnounceList().DistinctValues(), " "), tracker) {
+		t.Fatalf("tracker missing from %v", gotMi.UpvertedAnnounceList())
+	}
+}
+
+func TestErrors(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+	mi, err := c.Upload(ctx, "test", []UploadFile{
+		{Path: "a", Data: strings.NewReader("a")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Open(ctx, mi.HashInfoBytes(), "nope")
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.StatusCode != http.StatusNotFound || e.Body.Code != confluence.ErrorCodeFileNotFound {
+		t.Fatalf("unexpected error: %#v", e)
+	}
+	if e.Body.Infohash != mi.HashInfoBytes().HexString() {
+		t.Fatalf("unexpected infohash in error: %q", e.Body.Infohash)
+	}
+}
+
+// Routes responding with metainfos still give errors as JSON.
+func TestUploadError(t *testing.T) {
+	c := newTestClient(t)
+	_, err := c.Upload(context.Background(), "", []UploadFile{{Path: "a", Data: strings.NewReader("a")}})
+	var e *Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusBadRequest || e.Body.Code != confluence.ErrorCodeBadRequest {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSeedDir(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0o644)
+	h := newTestHandler(t)
+	h.ExtraRoutes = []confluence.Route{h.SeedDirRoute()}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	c := &Client{Address: srv.URL}
+	ctx := context.Background()
+	_, err := c.SeedDir(ctx, dir, nil)
+	var e *Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusForbidden || e.Body.Code != confluence.ErrorCodeForbidden {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h.SeedDirs = []string{dir}
+	mi, err := c.SeedDir(ctx, dir, url.Values{"version": {"hybrid"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.HasV1() || !info.HasV2() || info.TotalLength() != 1 {
+		t.Fatalf("unexpected info: %#v", info)
+	}
+}
+
+func TestEventsClosedWithContext(t *testing.T) {
+	c := newTestClient(t)
+	mi, err := c.Upload(context.Background(), "test", []UploadFile{
+		{Path: "a", Data: strings.NewReader("a")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := c.Events(ctx, mi.HashInfoBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	for range events {
+	}
+}
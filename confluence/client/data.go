@@ -0,0 +1,122 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Opens the file with the given display path in the torrent, or the whole torrent if the path is
+// empty. Reads block until confluence has the data. Seeking is implemented with range requests, so
+// the returned reader can be used with http.ServeContent and the like.
+func (c *Client) Open(ctx context.Context, ih metainfo.Hash, path string) (io.ReadSeekCloser, error) {
+	q := torrentQuery(ih)
+	if path != "" {
+		q.Set("path", path)
+	}
+	r := &dataReader{
+		ctx:   ctx,
+		c:     c,
+		query: q,
+	}
+	// The first response gives us the size, and any errors about the torrent or path.
+	resp, err := r.request()
+	if err != nil {
+		return nil, err
+	}
+	if resp.ContentLength < 0 {
+		resp.Body.Close()
+		return nil, errors.New("data response has unknown length")
+	}
+	r.size = resp.ContentLength
+	r.body = resp.Body
+	return r, nil
+}
+
+type dataReader struct {
+	ctx   context.Context
+	c     *Client
+	query url.Values
+	size  int64
+	pos   int64
+	// The response body for the current position, if there is one.
+	body   io.ReadCloser
+	closed bool
+}
+
+func (r *dataReader) request() (*http.Response, error) {
+	req, err := r.c.newRequest(r.ctx, http.MethodGet, "/data", r.query, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.pos == 0 {
+		return r.c.do(req, http.StatusOK)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.pos))
+	return r.c.do(req, http.StatusPartialContent)
+}
+
+func (r *dataReader) Read(b []byte) (n int, err error) {
+	if r.closed {
+		return 0, errors.New("reader closed")
+	}
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		var resp *http.Response
+		resp, err = r.request()
+		if err != nil {
+			return
+		}
+		r.body = resp.Body
+	}
+	n, err = r.body.Read(b)
+	r.pos += int64(n)
+	if err == io.EOF {
+		r.body.Close()
+		r.body = nil
+		if r.pos < r.size {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return
+}
+
+func (r *dataReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.size + offset
+	default:
+		return r.pos, fmt.Errorf("invalid whence: %v", whence)
+	}
+	if pos < 0 {
+		return r.pos, errors.New("negative position")
+	}
+	if pos != r.pos && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *dataReader) Close() error {
+	r.closed = true
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -0,0 +1,290 @@
+package confluence
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dht/v2"
+	"github.com/anacrolix/dht/v2/int160"
+	peer_store "github.com/anacrolix/dht/v2/peer-store"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Applies the "timeout" query parameter, a duration such as "10s", to the request context.
+func timeoutParamContext(r *http.Request) (ctx context.Context, cancel context.CancelFunc, err error) {
+	s := r.URL.Query().Get("timeout")
+	if s == "" {
+		ctx, cancel = context.WithCancel(r.Context())
+		return
+	}
+	timeout, err := time.ParseDuration(s)
+	if err != nil {
+		err = fmt.Errorf("parsing timeout: %w", err)
+		return
+	}
+	ctx, cancel = context.WithTimeout(r.Context(), timeout)
+	return
+}
+
+type dhtBucket struct {
+	// The number of leading bits node IDs in the bucket share with the server's.
+	Index int           `json:"index"`
+	Count int           `json:"count"`
+	Nodes []dhtNodeJson `json:"nodes,omitempty"`
+}
+
+type dhtNodeJson struct {
+	Id   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+type dhtServerStatus struct {
+	Server                                string      `json:"server"`
+	Addr                                  string      `json:"addr"`
+	Id                                    string      `json:"id"`
+	Nodes                                 int         `json:"nodes"`
+	GoodNodes                             int         `json:"goodNodes"`
+	BadNodes                              uint        `json:"badNodes"`
+	OutstandingTransactions               int         `json:"outstandingTransactions"`
+	OutboundQueriesAttempted              int64       `json:"outboundQueriesAttempted"`
+	SuccessfulOutboundAnnouncePeerQueries int64       `json:"successfulOutboundAnnouncePeerQueries"`
+	Buckets                               []dhtBucket `json:"buckets"`
+}
+
+// Returns the routing table statistics for the server. Buckets only include nodes that aren't bad,
+// and empty buckets are omitted.
+func getDhtServerStatus(s *dht.Server, withNodes bool) (ret dhtServerStatus) {
+	stats := s.Stats()
+	id := s.ID()
+	ret = dhtServerStatus{
+		Server:                                s.String(),
+		Addr:                                  s.Addr().String(),
+		Id:                                    hex.EncodeToString(id[:]),
+		Nodes:                                 stats.Nodes,
+		GoodNodes:                             stats.GoodNodes,
+		BadNodes:                              stats.BadNodes,
+		OutstandingTransactions:               stats.OutstandingTransactions,
+		OutboundQueriesAttempted:              stats.OutboundQueriesAttempted,
+		SuccessfulOutboundAnnouncePeerQueries: stats.SuccessfulOutboundAnnouncePeerQueries,
+		Buckets:                               []dhtBucket{},
+	}
+	root := int160.FromByteArray(id)
+	buckets := make(map[int]*dhtBucket)
+	for _, ni := range s.Nodes() {
+		distance := int160.Distance(root, int160.FromByteArray(ni.ID))
+		index := 160 - distance.BitLen()
+		b := buckets[index]
+		if b == nil {
+			b = &dhtBucket{Index: index}
+			buckets[index] = b
+		}
+		b.Count++
+		if withNodes {
+			b.Nodes = append(b.Nodes, dhtNodeJson{hex.EncodeToString(ni.ID[:]), ni.Addr.String()})
+		}
+	}
+	for _, b := range buckets {
+		ret.Buckets = append(ret.Buckets, *b)
+	}
+	slices.SortFunc(ret.Buckets, func(a, b dhtBucket) int {
+		return a.Index - b.Index
+	})
+	return
+}
+
+// Responds with the routing table statistics of each DHT server, and their nodes if the "nodes"
+// parameter is set.
+func (h *Handler) dhtHandler(w http.ResponseWriter, r *http.Request) {
+	withNodes, _ := strconv.ParseBool(r.URL.Query().Get("nodes"))
+	servers := make([]dhtServerStatus, 0, len(h.DhtServers))
+	for _, s := range h.DhtServers {
+		servers = append(servers, getDhtServerStatus(s, withNodes))
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	json.NewEncoder(w).Encode(struct {
+		Servers []dhtServerStatus `json:"servers"`
+	}{servers})
+}
+
+// The result of a get_peers traversal with one of the Handler's DHT servers.
+type dhtGetPeersResult struct {
+	Server string `json:"server"`
+	// Distinct peers returned by nodes, sorted.
+	Peers         []string `json:"peers"`
+	NodesTried    uint32   `json:"nodesTried"`
+	NodeResponses uint32   `json:"nodeResponses"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// Traverses the DHT for peers of the infohash with the server, announcing to the closest nodes
+// found if opts include dht.AnnouncePeer. The traversal ends when it stalls, or ctx is done, in which case there
+// is no announce.
+func dhtGetPeersWithServer(
+	ctx context.Context, s *dht.Server, ih metainfo.Hash, opts ...dht.AnnounceOpt,
+) (ret dhtGetPeersResult) {
+	ret.Server = s.String()
+	ret.Peers = []string{}
+	a, err := s.AnnounceTraversal(ih, opts...)
+	if err != nil {
+		ret.Error = err.Error()
+		return
+	}
+	defer a.Close()
+	peers := make(map[string]struct{})
+	defer func() {
+		for p := range peers {
+			ret.Peers = append(ret.Peers, p)
+		}
+		slices.Sort(ret.Peers)
+		stats := a.TraversalStats()
+		ret.NodesTried = stats.NumAddrsTried
+		ret.NodeResponses = stats.NumResponses
+	}()
+	for {
+		select {
+		case pv, ok := <-a.Peers:
+			if !ok {
+				return
+			}
+			for _, p := range pv.Peers {
+				peers[p.String()] = struct{}{}
+			}
+		case <-ctx.Done():
+			ret.Error = ctx.Err().Error()
+			return
+		}
+	}
+}
+
+// Runs get_peers for the infohash in the "ih" query parameter with each DHT server, and responds
+// with the peers found. If announce is set, the Handler's torrent client is announced as a peer.
+func (h *Handler) dhtGetPeers(w http.ResponseWriter, r *http.Request, announce bool) {
+	rt, err := TorrentFromInfohashQuery(r)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadInfohash, err.Error())
+		return
+	}
+	ctx, cancel, err := timeoutParamContext(r)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	defer cancel()
+	if len(h.DhtServers) == 0 {
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeNoDhtServers, "no dht servers")
+		return
+	}
+	ih := rt.shortInfohash()
+	var opts []dht.AnnounceOpt
+	if announce {
+		// Without a torrent client, nodes are asked to use the port the announce comes from.
+		peerOpts := dht.AnnouncePeerOpts{ImpliedPort: true}
+		if h.TC != nil {
+			peerOpts = dht.AnnouncePeerOpts{Port: h.TC.LocalPort()}
+		}
+		opts = append(opts, dht.AnnouncePeer(peerOpts))
+	}
+	results := make([]dhtGetPeersResult, len(h.DhtServers))
+	var wg sync.WaitGroup
+	for i, s := range h.DhtServers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = dhtGetPeersWithServer(ctx, s, ih, opts...)
+		}()
+	}
+	wg.Wait()
+	w.Header().Set("Content-Type", jsonContentType)
+	json.NewEncoder(w).Encode(struct {
+		Infohash string              `json:"infohash"`
+		Results  []dhtGetPeersResult `json:"results"`
+	}{
+		Infohash: ih.HexString(),
+		Results:  results,
+	})
+}
+
+type dhtStoredPeer struct {
+	Addr string `json:"addr"`
+	// When the peer was announced, if the peer store records it.
+	Added *time.Time `json:"added,omitempty"`
+}
+
+type dhtPeerStoreResult struct {
+	Server string `json:"server"`
+	// Stored peers by hex infohash.
+	Peers map[string][]dhtStoredPeer `json:"peers"`
+	Error string                     `json:"error,omitempty"`
+}
+
+// Returns the peers the server stores from announces by other nodes, for the infohash if given,
+// otherwise for all infohashes if the peer store supports listing them.
+func dhtPeerStoreContents(s *dht.Server, ih *metainfo.Hash) (ret dhtPeerStoreResult) {
+	ret.Server = s.String()
+	ret.Peers = make(map[string][]dhtStoredPeer)
+	ps := s.PeerStore()
+	if ps == nil {
+		ret.Error = "no peer store"
+		return
+	}
+	lister, ok := ps.(interface {
+		GetAll() map[peer_store.InfoHash][]peer_store.NodeAndTime
+	})
+	switch {
+	case ok:
+		for storedIh, nats := range lister.GetAll() {
+			if ih != nil && storedIh != *ih {
+				continue
+			}
+			for _, nat := range nats {
+				ret.Peers[storedIh.HexString()] = append(ret.Peers[storedIh.HexString()], dhtStoredPeer{
+					Addr:  nat.NodeAddr.String(),
+					Added: &nat.Time,
+				})
+			}
+		}
+	case ih != nil:
+		for _, na := range ps.GetPeers(*ih) {
+			ret.Peers[ih.HexString()] = append(ret.Peers[ih.HexString()], dhtStoredPeer{Addr: na.String()})
+		}
+	default:
+		ret.Error = fmt.Sprintf("peer store %T doesn't support listing", ps)
+	}
+	for _, peers := range ret.Peers {
+		slices.SortFunc(peers, func(a, b dhtStoredPeer) int {
+			return strings.Compare(a.Addr, b.Addr)
+		})
+	}
+	return
+}
+
+// Responds with the contents of the peer store of each DHT server, limited to the infohash in the
+// "ih" query parameter if it's given.
+func (h *Handler) dhtPeerStoreHandler(w http.ResponseWriter, r *http.Request) {
+	var ih *metainfo.Hash
+	if r.URL.Query().Get(infohashQueryKey) != "" {
+		rt, err := TorrentFromInfohashQuery(r)
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, ErrorCodeBadInfohash, err.Error())
+			return
+		}
+		short := rt.shortInfohash()
+		ih = &short
+	}
+	results := make([]dhtPeerStoreResult, 0, len(h.DhtServers))
+	for _, s := range h.DhtServers {
+		results = append(results, dhtPeerStoreContents(s, ih))
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	json.NewEncoder(w).Encode(struct {
+		Results []dhtPeerStoreResult `json:"results"`
+	}{results})
+}
@@ -0,0 +1,97 @@
+package confluence
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func testDhtJson(t *testing.T, h http.Handler, method, target string, ret any) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%v %v: %v %q", method, target, w.Code, w.Body.String())
+	}
+	err := json.Unmarshal(w.Body.Bytes(), ret)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Announces through one Handler, and finds the peer through another, over a local DHT.
+func TestDhtAnnounceGetPeers(t *testing.T) {
+	servers := testingDhtServers(t, 3)
+	announcer := &Handler{DhtServers: servers[:1]}
+	finder := &Handler{DhtServers: servers[2:]}
+	ih := metainfo.NewHashFromHex("08ada5a7a6183aae1e09d831df6748d566095a10")
+	query := "?" + url.Values{"ih": {ih.HexString()}, "timeout": {"10s"}}.Encode()
+	var announced struct {
+		Infohash string              `json:"infohash"`
+		Results  []dhtGetPeersResult `json:"results"`
+	}
+	testDhtJson(t, announcer, http.MethodPost, "/dht/announce"+query, &announced)
+	if announced.Infohash != ih.HexString() || len(announced.Results) != 1 || announced.Results[0].Error != "" || announced.Results[0].NodeResponses == 0 {
+		t.Fatalf("announce: %+v", announced)
+	}
+	// The announce used the DHT server's port, as there's no torrent client.
+	peer := "127.0.0.1:" + strconv.Itoa(servers[0].Addr().(*net.UDPAddr).Port)
+	// Nodes store announced peers asynchronously.
+	deadline := time.Now().Add(10 * time.Second)
+	for stored := 0; stored != 2; {
+		var res struct {
+			Results []dhtPeerStoreResult `json:"results"`
+		}
+		testDhtJson(t, &Handler{DhtServers: servers[1:]}, http.MethodGet, "/dht/peerStore?ih="+ih.HexString(), &res)
+		stored = 0
+		for _, res := range res.Results {
+			if peers := res.Peers[ih.HexString()]; len(peers) == 1 && peers[0].Addr == peer && peers[0].Added != nil {
+				stored++
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peer store: %+v", res)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The finder may only know the announcer, which doesn't return nodes it hasn't heard from
+	// recently, so it's introduced to the others.
+	for _, s := range servers[:2] {
+		if err := servers[2].Ping(s.Addr().(*net.UDPAddr)).Err; err != nil {
+			t.Fatal(err)
+		}
+	}
+	var found struct {
+		Results []dhtGetPeersResult `json:"results"`
+	}
+	testDhtJson(t, finder, http.MethodGet, "/dht/peers"+query, &found)
+	if len(found.Results) != 1 || len(found.Results[0].Peers) != 1 || found.Results[0].Peers[0] != peer {
+		t.Fatalf("get peers: %+v", found)
+	}
+
+	var status struct {
+		Servers []dhtServerStatus `json:"servers"`
+	}
+	testDhtJson(t, finder, http.MethodGet, "/dht?nodes=1", &status)
+	s := status.Servers[0]
+	if s.Nodes != 2 || len(s.Buckets) == 0 {
+		t.Fatalf("status: %+v", s)
+	}
+	var bucketNodes int
+	for _, b := range s.Buckets {
+		if b.Count != len(b.Nodes) {
+			t.Fatalf("bucket: %+v", b)
+		}
+		bucketNodes += b.Count
+	}
+	if bucketNodes != s.Nodes {
+		t.Fatalf("buckets: %+v", s.Buckets)
+	}
+}
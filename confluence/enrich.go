@@ -0,0 +1,119 @@
+package confluence
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+const enrichQueryKey = "enrich"
+
+func wantsEnrichment(r *http.Request) bool {
+	enrich, err := strconv.ParseBool(r.URL.Query().Get(enrichQueryKey))
+	return err == nil && enrich
+}
+
+// The URL of the Handler as seen by others, for links back to it.
+func (h *Handler) baseUrl(r *http.Request) *url.URL {
+	if h.BaseUrl != nil {
+		return h.BaseUrl
+	}
+	u := &url.URL{Scheme: "http", Host: r.Host}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	return u
+}
+
+// Addresses the torrent client can be reached at by peers and DHT nodes. The public IPs of the
+// client are used if they're known, and otherwise the host the request was made to.
+func (h *Handler) clientAddrs(r *http.Request) (ret []string) {
+	port := strconv.Itoa(h.TC.LocalPort())
+	if port == "0" {
+		return
+	}
+	for _, ip := range h.TC.PublicIPs() {
+		ret = append(ret, net.JoinHostPort(ip.String(), port))
+	}
+	if len(ret) == 0 {
+		host := h.baseUrl(r).Hostname()
+		if host != "" {
+			ret = append(ret, net.JoinHostPort(host, port))
+		}
+	}
+	return
+}
+
+// A web seed (BEP 19) for the torrent served by this Handler, see the /webseed route.
+func (h *Handler) webseedUrl(r *http.Request, mi *metainfo.MetaInfo) (string, bool) {
+	ih, ok := metainfoCanonicalInfohash(mi)
+	if !ok {
+		return "", false
+	}
+	return h.baseUrl(r).JoinPath("webseed", ih).String() + "/", true
+}
+
+// Adds the implicit trackers, the torrent client's address as a DHT node, and a web seed for this
+// Handler, so that the metainfo is immediately usable by others.
+func (h *Handler) enrichMetainfo(r *http.Request, mi *metainfo.MetaInfo) {
+	existing := mi.UpvertedAnnounceList().DistinctValues()
+	var tier []string
+	for _, tr := range h.ImplicitTrackers {
+		if !slices.Contains(existing, tr) {
+			tier = append(tier, tr)
+		}
+	}
+	if len(tier) != 0 {
+		mi.AnnounceList = append(mi.UpvertedAnnounceList(), tier)
+		if mi.Announce == "" {
+			mi.Announce = mi.AnnounceList[0][0]
+		}
+	}
+	if len(h.TC.DhtServers()) != 0 {
+		for _, addr := range h.clientAddrs(r) {
+			if !slices.Contains(mi.Nodes, metainfo.Node(addr)) {
+				mi.Nodes = append(mi.Nodes, metainfo.Node(addr))
+			}
+		}
+	}
+	if ws, ok := h.webseedUrl(r, mi); ok && !slices.Contains(mi.UrlList, ws) {
+		mi.UrlList = append(mi.UrlList, ws)
+	}
+}
+
+func (h *Handler) magnetHandler(w http.ResponseWriter, r *TorrentRequest) {
+	if !waitForTorrentInfo(w, r) {
+		return
+	}
+	mi := r.Torrent.Metainfo()
+	enrich := wantsEnrichment(r.Request)
+	if enrich {
+		h.enrichMetainfo(r.Request, &mi)
+	}
+	m, err := h.metainfoMagnet(r.Request, &mi, enrich)
+	if err != nil {
+		r.error(w, http.StatusInternalServerError, ErrorCodeInternal, fmt.Sprintf("making magnet: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", textContentType)
+	fmt.Fprintln(w, m)
+}
+
+// Returns the magnet link for the metainfo. If it was enriched, the torrent client is included as a
+// peer.
+func (h *Handler) metainfoMagnet(r *http.Request, mi *metainfo.MetaInfo, enriched bool) (string, error) {
+	m, err := mi.MagnetV2()
+	if err != nil {
+		return "", err
+	}
+	if enriched {
+		// Magnet links don't have DHT nodes, but the torrent client is also a peer.
+		m.Params["x.pe"] = append(m.Params["x.pe"], h.clientAddrs(r)...)
+	}
+	return m.String(), nil
+}
@@ -0,0 +1,76 @@
+package confluence
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Adds a single-file torrent to the handler through POST /metainfo.
+func testPostSingleFileMetainfo(t *testing.T, h http.Handler, name, data string) metainfo.Hash {
+	info := metainfo.Info{Name: name, Length: int64(len(data)), PieceLength: 1 << 14}
+	var err error
+	info.Pieces, err = metainfo.GeneratePieces(strings.NewReader(data), info.PieceLength, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi := metainfo.MetaInfo{InfoBytes: bencode.MustMarshal(info)}
+	postTestMetainfo(t, h, &mi)
+	return mi.HashInfoBytes()
+}
+
+func TestMagnetEnrich(t *testing.T) {
+	h := testingHandler(t)
+	h.ImplicitTrackers = []string{"http://tracker.example/announce"}
+	h.BaseUrl = &url.URL{Scheme: "https", Host: "confluence.example"}
+	ih := testPostSingleFileMetainfo(t, h, "file name", "hello")
+	for _, enrich := range []bool{false, true} {
+		target := "/magnet?ih=" + ih.HexString()
+		if enrich {
+			target += "&enrich=1"
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatal(w.Code)
+		}
+		m, err := metainfo.ParseMagnetV2Uri(strings.TrimSpace(w.Body.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.InfoHash.Value != ih || m.DisplayName != "file name" {
+			t.Fatalf("%v %q", m.InfoHash, m.DisplayName)
+		}
+		ws := "https://confluence.example/webseed/" + ih.HexString() + "/"
+		if slices.Equal(m.Trackers, h.ImplicitTrackers) != enrich || slices.Contains(m.Params["ws"], ws) != enrich {
+			t.Errorf("enrich=%v: trackers %q, web seeds %q", enrich, m.Trackers, m.Params["ws"])
+		}
+		if (len(m.Params["x.pe"]) != 0) != enrich {
+			t.Errorf("enrich=%v: peers %q", enrich, m.Params["x.pe"])
+		}
+	}
+}
+
+func TestMetainfoEnrich(t *testing.T) {
+	h := testingHandler(t)
+	h.ImplicitTrackers = []string{"http://tracker.example/announce"}
+	ih := testPostSingleFileMetainfo(t, h, "file", "hello")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://confluence.example/metainfo?enrich=true&ih="+ih.HexString(), nil))
+	mi, err := metainfo.Load(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(mi.UpvertedAnnounceList().DistinctValues(), h.ImplicitTrackers) {
+		t.Errorf("trackers %q", mi.UpvertedAnnounceList())
+	}
+	if !slices.Equal(mi.UrlList, []string{"http://confluence.example/webseed/" + ih.HexString() + "/"}) {
+		t.Errorf("web seeds %q", mi.UrlList)
+	}
+}
@@ -0,0 +1,169 @@
+package confluence
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/anacrolix/torrent"
+)
+
+// Identifies the kind of failure in an error response. The values are stable, clients can switch
+// on them instead of matching messages.
+type ErrorCode string
+
+const (
+	// The request was malformed, such as missing or invalid parameters.
+	ErrorCodeBadRequest ErrorCode = "bad_request"
+	// The torrent for the request couldn't be determined from the infohash or magnet given.
+	ErrorCodeBadInfohash ErrorCode = "bad_infohash"
+	// The request body wasn't a valid bencoded metainfo.
+	ErrorCodeBadMetainfo ErrorCode = "bad_metainfo"
+	// The torrent info isn't available yet, and the request asked not to wait for it.
+	ErrorCodeInfoNotReady ErrorCode = "info_not_ready"
+	// The torrent info doesn't match what the request expected, such as the exact length given in a
+	// magnet link.
+	ErrorCodeInfoMismatch ErrorCode = "info_mismatch"
+	// The path given doesn't match a file in the torrent.
+	ErrorCodeFileNotFound ErrorCode = "file_not_found"
+	// The requested item or route doesn't exist.
+	ErrorCodeNotFound ErrorCode = "not_found"
+	// The route doesn't support the request method. The Allow header lists those it does.
+	ErrorCodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	// The client went away or cancelled before a response was ready.
+	ErrorCodeRequestCanceled ErrorCode = "request_canceled"
+	// The handler has no DHT servers to service the request.
+	ErrorCodeNoDhtServers ErrorCode = "no_dht_servers"
+	// The Handler's configuration doesn't allow the request, such as a path outside
+	// Handler.SeedDirs.
+	ErrorCodeForbidden ErrorCode = "forbidden"
+	// The request conflicts with the state of the server, such as another upload in progress with
+	// the same id.
+	ErrorCodeConflict ErrorCode = "conflict"
+	// The request body is larger than the route allows.
+	ErrorCodeTooLarge ErrorCode = "too_large"
+	// Something failed on the server side.
+	ErrorCodeInternal ErrorCode = "internal"
+)
+
+// Every ErrorCode, and how it's handled. The OpenAPI spec's enum is built from this, and a new code
+// must be added here to declare whether it's retryable. Codes can't be listed twice, as duplicate
+// constant keys in a map literal don't compile.
+var errorCodes = map[ErrorCode]struct {
+	// Whether a request that failed with this code might succeed if made again unchanged.
+	retryable bool
+}{
+	ErrorCodeBadRequest:       {},
+	ErrorCodeBadInfohash:      {},
+	ErrorCodeBadMetainfo:      {},
+	ErrorCodeInfoNotReady:     {retryable: true},
+	ErrorCodeInfoMismatch:     {},
+	ErrorCodeFileNotFound:     {},
+	ErrorCodeNotFound:         {},
+	ErrorCodeMethodNotAllowed: {},
+	ErrorCodeRequestCanceled:  {retryable: true},
+	ErrorCodeNoDhtServers:     {},
+	ErrorCodeForbidden:        {},
+	ErrorCodeConflict:         {},
+	ErrorCodeTooLarge:         {},
+	ErrorCodeInternal:         {},
+}
+
+// Whether a request that failed with this code might succeed if made again unchanged.
+func (me ErrorCode) Retryable() bool {
+	return errorCodes[me].retryable
+}
+
+// The body of an error response when the client accepts JSON.
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// The hex infohash of the torrent the request was for, if it was determined.
+	Infohash  string `json:"infohash,omitempty"`
+	Retryable bool   `json:"retryable"`
+}
+
+func (me *Error) Error() string {
+	return me.Message
+}
+
+func newError(code ErrorCode, msg string) *Error {
+	return &Error{
+		Code:      code,
+		Message:   msg,
+		Retryable: code.Retryable(),
+	}
+}
+
+// Returns true if the request lists application/json as an acceptable media type.
+func acceptsJson(r *http.Request) bool {
+	return acceptsMediaType(r, jsonContentType)
+}
+
+// Returns true if the request lists the media type as acceptable. Wildcards don't count, and a q
+// of 0 refuses the type.
+func acceptsMediaType(r *http.Request, want string) bool {
+	return acceptQuality(r, want) > 0
+}
+
+// Returns true if the request accepts JSON at least as much as alt, for routes that respond with
+// either.
+func prefersJson(r *http.Request, alt string) bool {
+	q := acceptQuality(r, jsonContentType)
+	return q > 0 && q >= acceptQuality(r, alt)
+}
+
+// Returns the q value the request's Accept header gives the media type, or 0 if it isn't listed.
+func acceptQuality(r *http.Request, want string) (ret float64) {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil || mediaType != want {
+				continue
+			}
+			q := 1.0
+			if s, ok := params["q"]; ok {
+				q, err = strconv.ParseFloat(s, 64)
+				if err != nil {
+					continue
+				}
+			}
+			ret = max(ret, q)
+		}
+	}
+	return
+}
+
+// Writes an error response. Clients that accept JSON get an Error, everyone else gets the message
+// in plain text as http.Error would do.
+func writeError(w http.ResponseWriter, r *http.Request, status int, e *Error) {
+	if !acceptsJson(r) {
+		http.Error(w, e.Message, status)
+		return
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", jsonContentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+func httpError(w http.ResponseWriter, r *http.Request, status int, code ErrorCode, msg string) {
+	writeError(w, r, status, newError(code, msg))
+}
+
+func torrentError(
+	w http.ResponseWriter, r *http.Request, t *torrent.Torrent,
+	status int, code ErrorCode, msg string,
+) {
+	e := newError(code, msg)
+	e.Infohash = t.InfoHash().HexString()
+	writeError(w, r, status, e)
+}
+
+func (r *TorrentRequest) error(w http.ResponseWriter, status int, code ErrorCode, msg string) {
+	torrentError(w, r.Request, r.Torrent, status, code, msg)
+}
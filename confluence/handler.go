@@ -1,11 +1,14 @@
 package confluence
 
 import (
+	"crypto/ed25519"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
 	"github.com/anacrolix/dht/v2"
+	"github.com/anacrolix/dht/v2/bep44"
 	"github.com/anacrolix/log"
 	"github.com/anacrolix/missinggo/v2/refclose"
 	"github.com/anacrolix/squirrel"
@@ -34,14 +37,73 @@ type Handler struct {
 
 	// Called as soon as a new torrent is added, with the cached metainfo if it's found.
 	OnNewTorrent func(newTorrent *torrent.Torrent, cachedMetainfo *metainfo.MetaInfo)
-	DhtServers   []*dht.Server
-	Storage      *storage.Client
+	// Called on specs before they're merged into torrents, such as those from cached metainfos
+	// (unless OnNewTorrent is set), magnet links, and metainfos posted by clients. For example to
+	// enforce a tracker policy.
+	ModifyTorrentSpec func(spec *torrent.TorrentSpec)
+	DhtServers        []*dht.Server
+	// Keys that BEP 44 mutable items can be signed with by the server, by name. See POST /bep44.
+	Bep44Keys map[string]ed25519.PrivateKey
+	// How long items from BEP 44 gets are cached for, by target. Puts through the Handler replace
+	// cached items. Zero disables the cache.
+	Bep44CacheDuration time.Duration
+	// How long the current infohashes of mutable torrents (BEP 46) are cached for, regardless of
+	// Bep44CacheDuration. Defaults to a minute, and negative disables the cache.
+	MutableTorrentCacheDuration time.Duration
+	Storage                     *storage.Client
 	// Alter metainfos returned from upload handler. For example to add trackers, nodes, comments etc.
 	ModifyUploadMetainfo func(mi *metainfo.MetaInfo)
+	// Trackers added to metainfos and magnet links requested with the "enrich" parameter.
+	ImplicitTrackers []string
+	// Enrich metainfos returned from the upload handler, as if the "enrich" parameter was given.
+	// This makes Confluence a web seed for its own uploads.
+	EnrichUploads bool
+	// The URL the Handler is reachable at by others, for links back to it such as web seeds. If
+	// nil, it's derived from the request.
+	BaseUrl *url.URL
+	// Served in addition to the built-in routes. These must be set before the Handler first serves
+	// a request.
+	ExtraRoutes []Route
+	// Directories on the server that torrents can be created from with POST /admin/seedDir, and
+	// seeded from in place. The files mustn't change while they're seeded. The route is only served
+	// if SeedDirRoute is added to ExtraRoutes.
+	SeedDirs []string
+	// Hosts web seeds can be fetched from, or "*" for any. Web seeds make the server fetch URLs
+	// given by clients, with POST /webseeds, magnet links and metainfo url-lists, so none are
+	// allowed by default.
+	WebseedHosts []string
+	// Directories on the server that torrent data can be imported from with POST /import.
+	ImportDirs []string
+	// Directory resumable upload sessions are kept in, see POST /upload/sessions. Sessions aren't
+	// available if it's empty.
+	UploadSessionDir string
+	// How long upload sessions are kept after a chunk was last written to them. Defaults to a day.
+	UploadSessionExpiry time.Duration
+	// Directory uploads are written to as they're received. Their data can only be stored once
+	// they're hashed, as storage needs the infohash. Defaults to the OS temporary directory, which
+	// may be in memory, so set it for large uploads.
+	UploadSpoolDir string
 
-	mux         http.ServeMux
-	initOnce    sync.Once
-	torrentRefs refclose.RefPool
+	mux http.ServeMux
+	// Every pattern registered with mux, in order.
+	muxPatterns      []string
+	registeredRoutes []Route
+	initOnce         sync.Once
+	torrentRefs      refclose.RefPool
+	webseedsMu       sync.Mutex
+	webseeds         map[*torrent.Torrent]map[string]*webseedStats
+	bep44CacheMu     sync.Mutex
+	bep44Cache       map[bep44.Target]bep44CacheEntry
+	// Guarded by bep44CacheMu.
+	mutableTorrentCache map[bep44.Target]mutableTorrentCacheEntry
+	uploadsMu           sync.Mutex
+	uploads             map[string]*uploadProgress
+	// Chunk writes in progress by upload session id, or -1 if the session is being finalized or
+	// removed. Guarded by uploadsMu.
+	uploadSessionWriters map[string]int
+	seededMu             sync.Mutex
+	// The directories torrents are seeded from in place, by infohash.
+	seeded map[metainfo.Hash]string
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -1,9 +1,18 @@
 package confluence
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/anacrolix/log"
+	"github.com/anacrolix/torrent/metainfo"
 )
 
 func TestHandlerDefaultInit(t *testing.T) {
@@ -17,3 +26,174 @@ func TestHandlerInitLog(t *testing.T) {
 	*h.Logger = log.Default.FilterLevel(log.NotSet)
 	h.init()
 }
+
+func TestErrorJson(t *testing.T) {
+	var h Handler
+	for _, target := range []string{"/info", "/info?ih=deadbeef", "/nonexistent"} {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Accept", "text/html, application/json;q=0.9")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest && w.Code != http.StatusNotFound {
+			t.Fatalf("%v: unexpected status %v", target, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("%v: unexpected content type %q", target, ct)
+		}
+		var e Error
+		err := json.NewDecoder(w.Body).Decode(&e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Code == "" || e.Message == "" || e.Retryable {
+			t.Fatalf("%v: unexpected error body %#v", target, e)
+		}
+	}
+}
+
+func TestErrorPlainText(t *testing.T) {
+	var h Handler
+	// JSON with a q of 0 is refused.
+	for _, accept := range []string{"", "application/json;q=0", "text/plain, application/json; q=0.0"} {
+		r := httptest.NewRequest(http.MethodGet, "/info", nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Fatal(w.Code)
+		}
+		if !strings.HasPrefix(w.Body.String(), "error determining requested infohash: ") {
+			t.Fatalf("%q: unexpected body %q", accept, w.Body.String())
+		}
+	}
+}
+
+// Uploads files with the given paths and contents in a torrent with the given name, and returns
+// the infohash.
+func testUpload(t *testing.T, h http.Handler, name string, files map[string]string) metainfo.Hash {
+	return testUploadMetainfo(t, h, map[string]string{"name": name}, files).HashInfoBytes()
+}
+
+func testUploadMetainfo(t *testing.T, h http.Handler, fields map[string]string, files map[string]string) *metainfo.MetaInfo {
+	return testMetainfoRequest(t, h, newUploadRequest(fields, files))
+}
+
+// Serves the request, and fails the test unless it responds with the status. Returns the body.
+func testRequest(t testing.TB, h http.Handler, r *http.Request, status int) *bytes.Buffer {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != status {
+		t.Fatalf("%v %v responded with %v: %q", r.Method, r.URL.Path, w.Code, w.Body.String())
+	}
+	return w.Body
+}
+
+// Serves the request, which must respond with the status, and decodes the JSON body.
+func testJsonRequest[T any](t testing.TB, h http.Handler, r *http.Request, status int) (ret T) {
+	t.Helper()
+	err := json.Unmarshal(testRequest(t, h, r, status).Bytes(), &ret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// Serves the request, which must succeed, and loads the metainfo in the body.
+func testMetainfoRequest(t testing.TB, h http.Handler, r *http.Request) *metainfo.MetaInfo {
+	t.Helper()
+	mi, err := metainfo.Load(testRequest(t, h, r, http.StatusOK))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mi
+}
+
+func newUploadRequest(fields map[string]string, files map[string]string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		fw, _ := mw.CreateFormFile("files", p)
+		io.WriteString(fw, files[p])
+	}
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	var h Handler
+	for _, tc := range []struct {
+		method, target, allow string
+	}{
+		{http.MethodDelete, "/data", "GET, HEAD"},
+		{http.MethodPost, "/info", "GET, HEAD"},
+		{http.MethodPut, "/metainfo", "GET, POST, HEAD"},
+		{http.MethodGet, "/upload", "POST"},
+		{http.MethodPost, "/data/infohash/deadbeef/file", "GET, HEAD"},
+	} {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		r.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%v %v: unexpected status %v", tc.method, tc.target, w.Code)
+			continue
+		}
+		if allow := w.Header().Get("Allow"); allow != tc.allow {
+			t.Errorf("%v %v: unexpected Allow %q", tc.method, tc.target, allow)
+		}
+		var e Error
+		json.NewDecoder(w.Body).Decode(&e)
+		if e.Code != ErrorCodeMethodNotAllowed {
+			t.Errorf("%v %v: unexpected error code %q", tc.method, tc.target, e.Code)
+		}
+	}
+}
+
+func TestDataInfohashPath(t *testing.T) {
+	h := testingHandler(t)
+	ih := testUpload(t, h, "test", map[string]string{"a": "hello", "b/c": "world"})
+	for target, expected := range map[string]string{
+		"/data/infohash/" + ih.HexString() + "/b/c": "world",
+		"/data/infohash/" + ih.HexString() + "/":    "helloworld",
+		"/data/infohash/" + ih.HexString():          "helloworld",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK || w.Body.String() != expected {
+			t.Errorf("%v: got %v %q", target, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestExtraRoutes(t *testing.T) {
+	h := testingHandler(t)
+	h.ExtraRoutes = []Route{{
+		Methods: []string{http.MethodGet},
+		Pattern: "/name",
+		Torrent: TorrentFromQuery,
+		TorrentHandler: func(w http.ResponseWriter, r *TorrentRequest) {
+			<-r.Torrent.GotInfo()
+			io.WriteString(w, r.Torrent.Name())
+		},
+		Doc: RouteDoc{Summary: "Torrent name"},
+	}}
+	ih := testUpload(t, h, "test", map[string]string{"a": "hello"})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/name?ih="+ih.HexString(), nil))
+	if w.Code != http.StatusOK || w.Body.String() != "test" {
+		t.Fatalf("got %v %q", w.Code, w.Body.String())
+	}
+}
@@ -2,40 +2,38 @@ package confluence
 
 import (
 	"context"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
-	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"strconv"
-	"strings"
-	"sync"
 	"time"
 
-	"github.com/anacrolix/dht/v2/bep44"
-	"github.com/anacrolix/dht/v2/exts/getput"
+	g "github.com/anacrolix/generics"
 	"github.com/anacrolix/log"
 	"github.com/anacrolix/missinggo/v2/httptoo"
 	"github.com/anacrolix/missinggo/v2/panicif"
 	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/bencode"
 	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
 	"golang.org/x/net/websocket"
 )
 
 const filePathQueryKey = "path"
 
-func dataQueryHandler(w http.ResponseWriter, r *request) {
+func dataQueryHandler(w http.ResponseWriter, r *TorrentRequest) {
 	q := r.URL.Query()
 	dataHandler(w, r, q.Get(filePathQueryKey),
 		// I'm not sure if we can use q.Has for this test, and the behaviour might differ.
 		len(q[filePathQueryKey]) != 0)
 }
 
-func dataPathHandler(w http.ResponseWriter, r *request) {
-	dp := strings.TrimPrefix(r.URL.Path, "/")
+func dataPathHandler(w http.ResponseWriter, r *TorrentRequest) {
+	dp := r.PathValue(filePathQueryKey)
 	dataHandler(w, r, dp, len(dp) != 0)
 }
 
@@ -43,12 +41,15 @@ func setFilenameContentDisposition(w http.ResponseWriter, filename string) {
 	w.Header().Set("Content-Disposition", "filename="+strconv.Quote(filename))
 }
 
-func dataHandler(w http.ResponseWriter, r *request,
+func dataHandler(w http.ResponseWriter, r *TorrentRequest,
 	// TODO: Use a generic Option type.
 	filePath string, filePathOk bool,
 ) {
+	if !waitForTorrentInfo(w, r) {
+		return
+	}
 	q := r.URL.Query()
-	t := r.torrent
+	t := r.Torrent
 	const filenameQueryKey = "filename"
 	hasFilename := q.Has(filenameQueryKey)
 	if hasFilename {
@@ -68,38 +69,46 @@ func (h *Handler) statusHandler(w http.ResponseWriter, r *http.Request) {
 	h.TC.WriteStatus(w)
 }
 
-func waitForTorrentInfo(w http.ResponseWriter, r *request) bool {
-	t := r.torrent
+// Waits for the torrent info, and checks it's consistent with the request. Writes an error and
+// returns false if the handler can't continue.
+func waitForTorrentInfo(w http.ResponseWriter, r *TorrentRequest) bool {
+	t := r.Torrent
 	if nowait, err := strconv.ParseBool(r.URL.Query().Get("nowait")); err == nil && nowait {
 		select {
 		case <-t.GotInfo():
 		default:
-			http.Error(w, "info not ready", http.StatusAccepted)
+			r.error(w, http.StatusAccepted, ErrorCodeInfoNotReady, "info not ready")
 			return false
 		}
 	} else {
 		select {
 		case <-t.GotInfo():
 		case <-r.Context().Done():
+			r.error(w, httptoo.StatusClientCancelledRequest, ErrorCodeRequestCanceled, "request canceled")
+			return false
+		}
+	}
+	if r.verifyInfo != nil {
+		err := r.verifyInfo(t.Info())
+		if err != nil {
+			r.error(w, http.StatusConflict, ErrorCodeInfoMismatch, err.Error())
 			return false
 		}
 	}
 	return true
 }
 
-func infoHandler(w http.ResponseWriter, r *request) {
+func infoHandler(w http.ResponseWriter, r *TorrentRequest) {
 	if !waitForTorrentInfo(w, r) {
 		return
 	}
-	mi := r.torrent.Metainfo()
+	mi := r.Torrent.Metainfo()
 	w.Write(mi.InfoBytes)
 }
 
-func eventHandler(w http.ResponseWriter, r *request) {
-	t := r.torrent
-	select {
-	case <-t.GotInfo():
-	case <-r.Context().Done():
+func eventHandler(w http.ResponseWriter, r *TorrentRequest) {
+	t := r.Torrent
+	if !waitForTorrentInfo(w, r) {
 		return
 	}
 	s := t.SubscribePieceStateChanges()
@@ -137,40 +146,58 @@ func eventHandler(w http.ResponseWriter, r *request) {
 	}.ServeHTTP(w, r.Request)
 }
 
-func fileStateHandler(w http.ResponseWriter, r *request) {
+func fileStateHandler(w http.ResponseWriter, r *TorrentRequest) {
 	path_ := r.URL.Query().Get(filePathQueryKey)
-	select {
-	case <-r.Context().Done():
-		http.Error(w, "request canceled", httptoo.StatusClientCancelledRequest)
+	if !waitForTorrentInfo(w, r) {
 		return
-	case <-r.torrent.GotInfo():
 	}
-	f := torrentFileByPath(r.torrent, path_)
+	f := torrentFileByPath(r.Torrent, path_)
 	if f == nil {
-		http.Error(w, "file not found", http.StatusNotFound)
+		r.error(w, http.StatusNotFound, ErrorCodeFileNotFound, "file not found")
 		return
 	}
 	panicif.NotNil(json.NewEncoder(w).Encode(f.State()))
 }
 
-func (h *Handler) metainfoHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "POST" {
-		h.metainfoPostHandler(w, r)
-		return
+// Responds with the state of the torrent as JSON. This doesn't wait for the info.
+func (h *Handler) torrentHandler(w http.ResponseWriter, r *TorrentRequest) {
+	t := r.Torrent
+	stats := t.Stats()
+	ret := struct {
+		InfoHash       string          `json:"infoHash"`
+		Name           string          `json:"name,omitempty"`
+		HaveInfo       bool            `json:"haveInfo"`
+		Length         int64           `json:"length,omitempty"`
+		BytesCompleted int64           `json:"bytesCompleted"`
+		ActivePeers    int             `json:"activePeers"`
+		Webseeds       []webseedStatus `json:"webseeds"`
+	}{
+		InfoHash:       t.InfoHash().HexString(),
+		Name:           t.Name(),
+		HaveInfo:       t.Info() != nil,
+		BytesCompleted: t.BytesCompleted(),
+		ActivePeers:    stats.ActivePeers,
+		Webseeds:       h.webseedStatuses(t),
+	}
+	if ret.HaveInfo {
+		ret.Length = t.Length()
 	}
-	h.withTorrentContextFromQuery(h.contextedMetainfoHandler).ServeHTTP(w, r)
+	w.Header().Set("Content-Type", jsonContentType)
+	json.NewEncoder(w).Encode(ret)
 }
 
-func (h *Handler) contextedMetainfoHandler(w http.ResponseWriter, r *request) {
-
+func (h *Handler) contextedMetainfoHandler(w http.ResponseWriter, r *TorrentRequest) {
 	if !waitForTorrentInfo(w, r) {
 		return
 	}
-	mi := r.torrent.Metainfo()
+	mi := r.Torrent.Metainfo()
+	if wantsEnrichment(r.Request) {
+		h.enrichMetainfo(r.Request, &mi)
+	}
 
-	switch r.Header.Get("Accept") {
-	case "application/json":
-		w.Header().Add("Content-Type", "application/json")
+	switch {
+	case prefersJson(r.Request, bittorrentContentType):
+		w.Header().Add("Content-Type", jsonContentType)
 		nodes := make([]string, len(mi.Nodes))
 		for _, n := range mi.Nodes {
 			nodes = append(nodes, string(n))
@@ -207,21 +234,21 @@ func (h *Handler) metainfoPostHandler(w http.ResponseWriter, r *http.Request) {
 	var mi metainfo.MetaInfo
 	err := bencode.NewDecoder(r.Body).Decode(&mi)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("error decoding body: %s", err), http.StatusBadRequest)
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadMetainfo, fmt.Sprintf("error decoding body: %s", err))
 		return
 	}
-	h.withTorrentContext(
-		func(w http.ResponseWriter, r *request) {
-			err := h.PutMetainfo(r.torrent, &mi)
+	h.WithTorrent(
+		func(*http.Request) (ResolvedTorrent, error) {
+			spec, _ := torrent.TorrentSpecFromMetaInfoErr(&mi)
+			return ResolvedTorrent{InfoHash: spec.InfoHash, InfoHashV2: spec.InfoHashV2}, nil
+		},
+		func(w http.ResponseWriter, r *TorrentRequest) {
+			err := h.PutMetainfo(r.Torrent, &mi)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("error putting metainfo: %s", err), http.StatusInternalServerError)
+				r.error(w, http.StatusInternalServerError, ErrorCodeInternal, fmt.Sprintf("error putting metainfo: %s", err))
 				return
 			}
-			fmt.Fprintln(w, r.torrent.InfoHash().HexString())
-		},
-		func() (ih metainfo.Hash, err error, afterAdd func(t *torrent.Torrent)) {
-			ih = mi.HashInfoBytes()
-			return
+			fmt.Fprintln(w, r.Torrent.InfoHash().HexString())
 		},
 	).ServeHTTP(w, r)
 }
@@ -231,196 +258,218 @@ func (h *Handler) metainfoPostHandler(w http.ResponseWriter, r *http.Request) {
 // metainfo.
 func (h *Handler) PutMetainfo(t *torrent.Torrent, mi *metainfo.MetaInfo) error {
 	spec, _ := torrent.TorrentSpecFromMetaInfoErr(mi)
-	err := t.MergeSpec(spec)
+	err := h.mergeSpec(t, spec)
 	if err != nil {
 		return err
 	}
 	return h.saveTorrentFile(t)
 }
 
-func (h *Handler) handleBep44(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
-	var target bep44.Target
-	targetBytes, err := hex.DecodeString(r.FormValue("target"))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	if copy(target[:], targetBytes) != len(target) {
-		http.Error(w, "target has bad length", http.StatusBadRequest)
-		return
+// Creates a torrent from the files in a multipart form, and stores their data. See receiveUpload.
+// If the id query parameter is given, progress can be followed with GET /upload/progress.
+func (h *Handler) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	var progress *uploadProgress
+	if id := r.URL.Query().Get("id"); id != "" {
+		var done func()
+		var err error
+		progress, done, err = h.trackUpload(id)
+		if err != nil {
+			httpError(w, r, http.StatusConflict, ErrorCodeConflict, err.Error())
+			return
+		}
+		defer done()
 	}
-	if len(h.DhtServers) == 0 {
-		http.Error(w, "no dht servers", http.StatusInternalServerError)
-		return
+	h.receiveUpload(w, r, progress)
+}
+
+// Returns the path within the torrent of an uploaded file, from the filename in its
+// Content-Disposition. The filename in multipart.FileHeader and multipart.Part can't be used
+// because it's stripped of directory components.
+func uploadFilePath(header textproto.MIMEHeader, stripTopDirectory bool) ([]string, error) {
+	_, params, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing file content-disposition: %w", err)
 	}
-	var wg sync.WaitGroup
-	resChan := make(chan getput.GetResult, len(h.DhtServers))
-	wgDoneChan := make(chan struct{})
-	for _, s := range h.DhtServers {
-		s := s
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			res, _, err := getput.Get(r.Context(), target, s, nil, []byte(r.FormValue("salt")))
-			if err != nil {
-				h.Logger.Levelf(log.Debug, "error getting %x from %v: %v", target, s, err)
-				return
-			}
-			resChan <- res
-		}()
-	}
-	go func() {
-		wg.Wait()
-		close(wgDoneChan)
-	}()
-	select {
-	case res := <-resChan:
-		bencode.NewEncoder(w).Encode(res.V)
-	case <-wgDoneChan:
-		http.Error(w, "not found", http.StatusNotFound)
+	filename, ok := params["filename"]
+	if !ok {
+		return nil, errors.New("missing filename in Content-Disposition")
 	}
+	return splitUploadPath(filename, stripTopDirectory)
 }
 
-func (h *Handler) uploadHandler(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseMultipartForm(10 << 20)
+// Finishes an upload once info is complete: the torrent data is stored if it isn't already, the
+// metainfo is saved, and written in the response. The options that don't affect hashing are applied here. data is the
+// torrent data in storage order, including padding between piece aligned files. If anything fails,
+// the pieces stored are marked incomplete again. Returns whether the upload succeeded.
+func (h *Handler) completeUpload(
+	w http.ResponseWriter, r *http.Request,
+	info *metainfo.Info, opts *uploadOptions, pieceLayers map[string]string, data io.Reader,
+	progress *uploadProgress,
+) (ok bool) {
+	mi, ih, err := newUploadMetainfo(info, opts, pieceLayers)
 	if err != nil {
-		err = fmt.Errorf("parsing multipart form: %w", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
 		return
 	}
-	info := metainfo.Info{
-		Name: r.MultipartForm.Value["name"][0],
-	}
-	//spew.Dump(r.MultipartForm)
-	files := r.MultipartForm.File["files"]
-	// Raw HTML directory file uploads don't support mixing files and directories with a single
-	// chooser. So if you need to select everything inside a directory, you have to upload the
-	// parent directory itself. This option strips that top-level directory name.
-	stripTopDirectory := len(r.MultipartForm.Value["strip-top-directory"]) > 0
-	for _, fh := range files {
-		_, params, err := mime.ParseMediaType(fh.Header.Get("Content-Disposition"))
+	torrentStorage, err := h.Storage.OpenTorrent(r.Context(), info, ih)
+	if err != nil {
+		err = fmt.Errorf("opening storage for torrent: %w", err)
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
+	}
+	defer torrentStorage.Close()
+	var stored []storedUploadPiece
+	// The same files were uploaded before if the pieces are already complete, and aren't read again.
+	if !uploadPiecesComplete(torrentStorage, info, pieceLayers) {
+		progress.storing(info.NumPieces())
+		stored, err = storeUploadPieces(r.Context(), torrentStorage, info, data, progress)
+	}
+	if err == nil {
+		// Save before running Handler.ModifyUploadMetainfo, because the modifications may be unique
+		// to different runs of confluence. The metainfo storage can't delete, so this is done once
+		// the data is in place.
+		err = h.saveMetaInfo(mi, ih)
 		if err != nil {
-			err = fmt.Errorf("parsing file content-disposition: %w", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+			err = fmt.Errorf("saving metainfo: %w", err)
 		}
-		filename, ok := params["filename"]
-		if !ok {
-			http.Error(w, "missing filename in Content-Disposition", http.StatusBadRequest)
+	}
+	if err != nil {
+		unstoreUploadPieces(h.Logger, torrentStorage, info, stored)
+		if r.Context().Err() != nil {
+			httpError(w, r, httptoo.StatusClientCancelledRequest, ErrorCodeRequestCanceled, "request canceled")
 			return
 		}
-		// Can't use multipart.FileHeader.Filename because it's stripped of directory components.
-		path := strings.Split(filename, "/")
-		// If the path only has a single component, it's a file in the top-level directory.
-		if len(path) > 1 && stripTopDirectory {
-			path = path[1:]
-		}
-		info.Files = append(info.Files, metainfo.FileInfo{
-			Length:   fh.Size,
-			Path:     path,
-			PathUtf8: path,
-		})
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
 	}
-	info.PieceLength = metainfo.ChoosePieceLength(info.TotalLength())
-	piecesReader, piecesWriter := io.Pipe()
-	generatePiecesErrChan := make(chan error, 1)
-	go func() {
-		var err error
-		info.Pieces, err = metainfo.GeneratePieces(piecesReader, info.PieceLength, nil)
-		generatePiecesErrChan <- err
-	}()
-	err = writeMultipartFiles(piecesWriter, files)
-	piecesWriter.Close()
+	h.writeUploadResult(w, r, info, &mi)
+	return true
+}
+
+// Returns the metainfo for a torrent created by the Handler, with the options applied, and the
+// infohash its data is stored under.
+func newUploadMetainfo(info *metainfo.Info, opts *uploadOptions, pieceLayers map[string]string) (
+	mi metainfo.MetaInfo, ih metainfo.Hash, err error,
+) {
+	opts.setInfo(info)
+	infoBytes, err := marshalInfo(info)
 	if err != nil {
-		err = fmt.Errorf("writing files to piece generator: %w", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		err = fmt.Errorf("marshalling info: %w", err)
 		return
 	}
-	generatePiecesErr := <-generatePiecesErrChan
-	if generatePiecesErr != nil {
-		panic(generatePiecesErr)
-	}
-	mi := metainfo.MetaInfo{
-		InfoBytes:    bencode.MustMarshal(info),
+	mi = metainfo.MetaInfo{
+		InfoBytes:    infoBytes,
+		PieceLayers:  pieceLayers,
 		CreatedBy:    "anacrolix/confluence upload",
 		CreationDate: time.Now().Unix(),
 	}
-	// Save before running Handler.ModifyUploadMetainfo, because the modifications may be unique to different runs of confluence.
-	err = h.saveMetaInfo(mi, mi.HashInfoBytes())
-	if err != nil {
-		err = fmt.Errorf("saving metainfo: %w", err)
-		log.Printf("error uploading: %v", err)
-	}
-	err = h.storeUploadPieces(r.Context(), &info, mi.HashInfoBytes(), files)
-	if err != nil {
-		err = fmt.Errorf("storing upload pieces: %w", err)
-		log.Printf("error uploading: %v", err)
+	opts.setMetainfo(&mi)
+	spec, _ := torrent.TorrentSpecFromMetaInfoErr(&mi)
+	ih = spec.InfoHash
+	if !info.HasV1() {
+		ih = *spec.InfoHashV2.Value.ToShort()
 	}
+	return
+}
+
+// Responds with the metainfo of a torrent created by the Handler, after Handler.ModifyUploadMetainfo
+// and enrichment, or its summary as JSON if the client accepts it.
+func (h *Handler) writeUploadResult(w http.ResponseWriter, r *http.Request, info *metainfo.Info, mi *metainfo.MetaInfo) {
 	if f := h.ModifyUploadMetainfo; f != nil {
-		f(&mi)
+		f(mi)
+	}
+	enrich := h.EnrichUploads || wantsEnrichment(r)
+	if enrich {
+		h.enrichMetainfo(r, mi)
 	}
+	if prefersJson(r, bittorrentContentType) {
+		h.writeUploadJson(w, r, info, mi, enrich)
+		return
+	}
+	w.Header().Set("Content-Type", bittorrentContentType)
 	mi.Write(w)
 }
 
-func writeMultipartFiles(w io.Writer, fhs []*multipart.FileHeader) error {
-	for _, fh := range fhs {
-		file, err := fh.Open()
-		if err != nil {
-			err = fmt.Errorf("opening file %q: %w", fh.Filename, err)
-			return err
-		}
-		_, err = io.Copy(w, file)
-		file.Close()
-		if err != nil {
-			err = fmt.Errorf("copying file: %w", err)
-			return err
-		}
-	}
-	return nil
+// A piece completed by an upload, with the hash it's stored by.
+type storedUploadPiece struct {
+	index int
+	hash  g.Option[[]byte]
 }
 
-func (h *Handler) storeUploadPieces(
+// Stores the torrent data read from r as complete pieces. Returns the pieces that weren't already
+// complete, including if it fails part way.
+func storeUploadPieces(
 	ctx context.Context,
+	torrentStorage *storage.Torrent,
 	info *metainfo.Info,
-	ih metainfo.Hash,
-	files []*multipart.FileHeader,
-) (err error) {
-	torrentStorage, err := h.Storage.OpenTorrent(ctx, info, ih)
-	if err != nil {
-		err = fmt.Errorf("opening storage for torrent: %w", err)
-		return
-	}
-	defer torrentStorage.Close()
-	r, w := io.Pipe()
-	go func() {
-		err := writeMultipartFiles(w, files)
-		if err != nil {
-			err = fmt.Errorf("writing upload multipart files: %w", err)
-		}
-		w.CloseWithError(err)
-	}()
-	defer r.Close()
+	r io.Reader,
+	progress *uploadProgress,
+) (stored []storedUploadPiece, err error) {
 	buf := make([]byte, info.PieceLength)
-pieces:
 	for pieceIndex := 0; ; pieceIndex++ {
-		numRead, err := io.ReadFull(r, buf)
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		var numRead int
+		numRead, err = io.ReadFull(r, buf)
 		switch err {
 		default:
-			return fmt.Errorf("reading piece %v: %w", pieceIndex, err)
+			err = fmt.Errorf("reading piece %v: %w", pieceIndex, err)
+			return
 		case io.EOF:
-			break pieces
+			err = nil
+			return
 		case nil, io.ErrUnexpectedEOF:
 		}
-		pieceStorage := torrentStorage.Piece(info.Piece(pieceIndex))
-		numWritten, err := pieceStorage.WriteAt(buf[:numRead], 0)
+		piece := info.Piece(pieceIndex)
+		// Pieces at the end of files in v2 torrents are short, and followed by padding.
+		numRead = min(numRead, int(piece.Length()))
+		hash := uploadPieceHash(piece, buf[:numRead])
+		pieceStorage := torrentStorage.PieceWithHash(piece, hash)
+		progress.pieceStored()
+		// Rewriting a complete piece would risk corrupting it if the write fails, and the data is
+		// the same as it has the same hash.
+		if c := pieceStorage.Completion(); c.Ok && c.Complete {
+			continue
+		}
+		var numWritten int
+		numWritten, err = pieceStorage.WriteAt(buf[:numRead], 0)
 		if numWritten != numRead {
-			return fmt.Errorf("writing piece %v: %w", pieceIndex, err)
+			err = fmt.Errorf("writing piece %v: %w", pieceIndex, err)
+			return
 		}
 		err = pieceStorage.MarkComplete()
 		if err != nil {
-			return fmt.Errorf("marking piece %v complete: %w", pieceIndex, err)
+			err = fmt.Errorf("marking piece %v complete: %w", pieceIndex, err)
+			return
+		}
+		stored = append(stored, storedUploadPiece{pieceIndex, hash})
+	}
+}
+
+// Returns whether all the pieces of a torrent are complete in storage. The piece layers are needed
+// for v2 torrents, as pieces are stored by their hashes.
+func uploadPiecesComplete(torrentStorage *storage.Torrent, info *metainfo.Info, pieceLayers map[string]string) bool {
+	files := info.UpvertedFiles()
+	for i := range info.NumPieces() {
+		p := info.Piece(i)
+		hash := expectedPieceHash(p, files, pieceLayers)
+		if !hash.Ok {
+			return false
+		}
+		if c := torrentStorage.PieceWithHash(p, hash).Completion(); !c.Ok || !c.Complete {
+			return false
+		}
+	}
+	return true
+}
+
+// Marks pieces stored by a failed upload as incomplete, so their data isn't trusted.
+func unstoreUploadPieces(logger *log.Logger, torrentStorage *storage.Torrent, info *metainfo.Info, stored []storedUploadPiece) {
+	for _, p := range stored {
+		err := torrentStorage.PieceWithHash(info.Piece(p.index), p.hash).MarkNotComplete()
+		if err != nil {
+			logger.Levelf(log.Warning, "marking piece %v of failed upload not complete: %v", p.index, err)
 		}
 	}
-	return nil
 }
@@ -0,0 +1,221 @@
+package confluence
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	g "github.com/anacrolix/generics"
+	"github.com/anacrolix/missinggo/v2/httptoo"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// The pieces of a torrent by what importing them from local files did.
+type importResultJson struct {
+	// Matched and written to storage.
+	Imported []int `json:"imported"`
+	// Already complete, so not read.
+	Complete []int `json:"complete"`
+	// Didn't match.
+	Mismatched []int `json:"mismatched"`
+	// Couldn't be read, such as when files are missing or short.
+	Missing []int `json:"missing"`
+	// The hash isn't known yet, as the torrent doesn't have all the v2 piece layers.
+	Unverifiable []int `json:"unverifiable"`
+}
+
+// Imports the torrent's data from files in a directory on the server within one of
+// Handler.ImportDirs, as another client would have downloaded it. Each piece is hashed, and those
+// that match are written to the torrent's storage and completed.
+func (h *Handler) importHandler(w http.ResponseWriter, r *TorrentRequest) {
+	dir, status, dirErr := allowedDirPath(r.URL.Query().Get("dir"), h.ImportDirs)
+	if dirErr != nil {
+		dirErr.Infohash = r.Torrent.InfoHash().HexString()
+		writeError(w, r.Request, status, dirErr)
+		return
+	}
+	if !waitForTorrentInfo(w, r) {
+		return
+	}
+	t := r.Torrent
+	info := t.Info()
+	local := localTorrentFiles{dir: dir, info: info, files: info.UpvertedFiles()}
+	pieceLayers := t.Metainfo().PieceLayers
+	var (
+		mu  sync.Mutex
+		ret importResultJson
+	)
+	record := func(list *[]int, piece int) {
+		mu.Lock()
+		*list = append(*list, piece)
+		mu.Unlock()
+	}
+	err := parallelFor(r.Context(), info.NumPieces(), func(i int) error {
+		piece := t.Piece(i)
+		if piece.State().Complete {
+			record(&ret.Complete, i)
+			return nil
+		}
+		p := info.Piece(i)
+		expected := expectedPieceHash(p, local.files, pieceLayers)
+		if !expected.Ok {
+			record(&ret.Unverifiable, i)
+			return nil
+		}
+		data := make([]byte, p.Length())
+		_, err := local.ReadAt(data, p.Offset())
+		if err != nil {
+			record(&ret.Missing, i)
+			return nil
+		}
+		if !bytes.Equal(pieceDataHash(p, local.files, data), expected.Value) {
+			record(&ret.Mismatched, i)
+			return nil
+		}
+		pieceStorage := piece.Storage()
+		_, err = pieceStorage.WriteAt(data, 0)
+		if err != nil {
+			return fmt.Errorf("writing piece %v: %w", i, err)
+		}
+		err = pieceStorage.MarkComplete()
+		if err != nil {
+			return fmt.Errorf("marking piece %v complete: %w", i, err)
+		}
+		// The Client may be checking the piece from before it was written, such as when the
+		// torrent was just added, so have it check again.
+		piece.VerifyData()
+		if !piece.State().Complete {
+			record(&ret.Mismatched, i)
+			return nil
+		}
+		record(&ret.Imported, i)
+		return nil
+	})
+	if err != nil {
+		if r.Context().Err() != nil {
+			r.error(w, httptoo.StatusClientCancelledRequest, ErrorCodeRequestCanceled, "request canceled")
+			return
+		}
+		r.error(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
+	}
+	for _, l := range []*[]int{&ret.Imported, &ret.Complete, &ret.Mismatched, &ret.Missing, &ret.Unverifiable} {
+		if *l == nil {
+			*l = []int{}
+		}
+		slices.Sort(*l)
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	json.NewEncoder(w).Encode(ret)
+}
+
+// Returns the hash of the piece from the info, or for v2 torrents the piece layers, in the form
+// the torrent Client gives it to storage. The files are the info's upverted files.
+func expectedPieceHash(p metainfo.Piece, files []metainfo.FileInfo, pieceLayers map[string]string) (
+	ret g.Option[[]byte],
+) {
+	if v1 := p.V1Hash(); v1.Ok {
+		return g.Some(v1.Value.Bytes())
+	}
+	return v2PieceHash(p, files, pieceLayers)
+}
+
+// Returns the v2 hash of the piece from the piece layers, or the pieces root of its file if the file
+// is a single piece. The files are the info's upverted files.
+func v2PieceHash(p metainfo.Piece, files []metainfo.FileInfo, pieceLayers map[string]string) (
+	ret g.Option[[]byte],
+) {
+	i, ok := fileAtOffset(files, p.Offset())
+	if !ok || !files[i].PiecesRoot.Ok {
+		return
+	}
+	root := files[i].PiecesRoot.Value
+	if files[i].Length <= p.Info.PieceLength {
+		return g.Some(root[:])
+	}
+	layer := pieceLayers[string(root[:])]
+	layerIndex := (p.Offset() - files[i].TorrentOffset) / p.Info.PieceLength
+	if int64(len(layer)) < (layerIndex+1)*32 {
+		return
+	}
+	return g.Some([]byte(layer[layerIndex*32 : (layerIndex+1)*32]))
+}
+
+// Returns the hash of the piece's data, in the form of expectedPieceHash.
+func pieceDataHash(p metainfo.Piece, files []metainfo.FileInfo, data []byte) []byte {
+	if !p.V1Hash().Ok {
+		i, _ := fileAtOffset(files, p.Offset())
+		return v2PieceDataHash(p, files[i].Length, data)
+	}
+	h := sha1.New()
+	h.Write(data)
+	// Pieces at the ends of files in hybrid torrents are padded with zeroes for v1.
+	io.CopyN(h, zeroReader{}, p.V1Length()-int64(len(data)))
+	return h.Sum(nil)
+}
+
+// Reads torrent data from files in a directory laid out as file storage does: the torrent's name,
+// and then its file paths.
+type localTorrentFiles struct {
+	dir   string
+	info  *metainfo.Info
+	files []metainfo.FileInfo
+}
+
+func (me *localTorrentFiles) path(fi *metainfo.FileInfo) (string, error) {
+	comps := []string{me.info.BestName()}
+	if me.info.IsDir() {
+		comps = append(comps, fi.BestPath()...)
+	}
+	rel, err := storage.ToSafeFilePath(comps...)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(me.dir, rel), nil
+}
+
+// Reads at a torrent offset. Padding files (BEP 47) read as zeroes, as they're often not on disk.
+func (me *localTorrentFiles) ReadAt(b []byte, off int64) (n int, err error) {
+	for n < len(b) {
+		i, ok := fileAtOffset(me.files, off+int64(n))
+		if !ok {
+			return n, io.EOF
+		}
+		fi := &me.files[i]
+		fileOff := off + int64(n) - fi.TorrentOffset
+		m := int(min(int64(len(b)-n), fi.Length-fileOff))
+		if strings.Contains(fi.Attr, "p") {
+			clear(b[n : n+m])
+			n += m
+			continue
+		}
+		m, err = me.readFile(fi, b[n:n+m], fileOff)
+		n += m
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (me *localTorrentFiles) readFile(fi *metainfo.FileInfo, b []byte, off int64) (int, error) {
+	path, err := me.path(fi)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.ReadAt(b, off)
+}
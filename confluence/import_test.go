@@ -0,0 +1,75 @@
+package confluence
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testImport(t *testing.T, h http.Handler, ih, dir string) importResultJson {
+	return testJsonRequest[importResultJson](t, h, httptest.NewRequest(
+		http.MethodPost, "/import?"+url.Values{"ih": {ih}, "dir": {dir}}.Encode(), nil), http.StatusOK)
+}
+
+func TestImport(t *testing.T) {
+	files := map[string]string{
+		"a":     strings.Repeat("a", 20000),
+		"dir/b": strings.Repeat("b", 30000),
+		"dir/c": strings.Repeat("c", 40000),
+		"e":     strings.Repeat("e", 20000),
+	}
+	for _, version := range []string{uploadVersionV1, uploadVersionV2, uploadVersionHybrid} {
+		mi := testUploadMetainfo(t, testingHandler(t), map[string]string{
+			"name":         "test",
+			"version":      version,
+			"piece-length": "16384",
+			"file-order":   "path",
+		}, files)
+		ih, _ := metainfoCanonicalInfohash(mi)
+		root := t.TempDir()
+		// Another client's download, with the start of a file corrupt, and the last file missing.
+		os.MkdirAll(filepath.Join(root, "test", "dir"), 0o755)
+		os.WriteFile(filepath.Join(root, "test", "a"), []byte(files["a"]), 0o644)
+		os.WriteFile(filepath.Join(root, "test", "dir", "b"), []byte(files["dir/b"]), 0o644)
+		os.WriteFile(filepath.Join(root, "test", "dir", "c"), []byte("x"+files["dir/c"][1:]), 0o644)
+		h := testingHandler(t)
+		h.ImportDirs = []string{root}
+		postTestMetainfo(t, h, mi)
+		res := testImport(t, h, ih, root)
+		if len(res.Imported) == 0 || len(res.Missing) == 0 || len(res.Mismatched) != 1 ||
+			len(res.Complete) != 0 || len(res.Unverifiable) != 0 {
+			t.Fatalf("%v: %+v", version, res)
+		}
+		// Imported pieces are served without fetching them.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/data/infohash/"+ih+"/a", nil).WithContext(ctx))
+		cancel()
+		if w.Body.String() != files["a"] {
+			t.Fatalf("%v: %v %q", version, w.Code, w.Body.String())
+		}
+		again := testImport(t, h, ih, root)
+		if len(again.Imported) != 0 || len(again.Complete) != len(res.Imported) {
+			t.Fatalf("%v: importing again: %+v", version, again)
+		}
+	}
+}
+
+func TestImportForbidden(t *testing.T) {
+	h := testingHandler(t)
+	h.ImportDirs = []string{t.TempDir()}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/import?"+url.Values{
+		"ih":  {"0123456789abcdef0123456789abcdef01234567"},
+		"dir": {t.TempDir()},
+	}.Encode(), nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("%v %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,112 @@
+package confluence
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	g "github.com/anacrolix/generics"
+	"github.com/anacrolix/torrent/metainfo"
+	infohash_v2 "github.com/anacrolix/torrent/types/infohash-v2"
+)
+
+// Multihash prefixes (function code and digest length) for the infohash hash functions.
+var (
+	sha1MultihashPrefix   = []byte{0x11, 0x14}
+	sha256MultihashPrefix = []byte{0x12, 0x20}
+)
+
+// Parses an infohash in any of the forms found in the wild: a v1 infohash as 40 hex or 32 base32
+// characters, a v2 infohash (BEP 52) as 64 hex characters, or either as a hex multihash, as in the
+// "urn:btmh:" of magnet links.
+func parseInfohash(s string) (v1 metainfo.Hash, v2 g.Option[infohash_v2.T], err error) {
+	switch len(s) {
+	case 32:
+		var b []byte
+		b, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+		if err != nil {
+			err = fmt.Errorf("decoding base32: %w", err)
+			return
+		}
+		copy(v1[:], b)
+		return
+	case 40:
+		err = v1.FromHexString(s)
+		return
+	case 64:
+		err = v2.Value.FromHexString(s)
+		v2.Ok = err == nil
+		return
+	case 44, 68:
+		var b []byte
+		b, err = hex.DecodeString(s)
+		if err != nil {
+			err = fmt.Errorf("decoding multihash: %w", err)
+			return
+		}
+		switch {
+		case len(b) == 22 && string(b[:2]) == string(sha1MultihashPrefix):
+			copy(v1[:], b[2:])
+		case len(b) == 34 && string(b[:2]) == string(sha256MultihashPrefix):
+			copy(v2.Value[:], b[2:])
+			v2.Ok = true
+		default:
+			err = fmt.Errorf("unsupported multihash %x", b[:2])
+		}
+		return
+	}
+	err = fmt.Errorf("expected 40 hex, 32 base32, 64 hex or multihash characters, got %v", len(s))
+	return
+}
+
+// The form infohashes are given in responses and canonical URLs: lowercase hex of the v1 infohash,
+// or of the v2 infohash if there's no v1.
+func canonicalInfohash(v1 metainfo.Hash, v2 g.Option[infohash_v2.T]) string {
+	if v1.IsZero() && v2.Ok {
+		return v2.Value.HexString()
+	}
+	return v1.HexString()
+}
+
+// Redirects requests with the infohash path wildcard in a non-canonical form, such as base32, to the
+// canonical URL. Invalid infohashes are left for the torrent resolver to reject.
+func canonicalInfohashPath(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := r.PathValue(InfohashPathWildcard)
+		v1, v2, err := parseInfohash(given)
+		canonical := canonicalInfohash(v1, v2)
+		if err != nil || given == canonical {
+			h.ServeHTTP(w, r)
+			return
+		}
+		u := *r.URL
+		segments := strings.Split(u.Path, "/")
+		for i, s := range segments {
+			if s == given {
+				segments[i] = canonical
+				break
+			}
+		}
+		u.Path = strings.Join(segments, "/")
+		u.RawPath = ""
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+	})
+}
+
+// The canonical infohash of a metainfo, if it has info bytes.
+func metainfoCanonicalInfohash(mi *metainfo.MetaInfo) (string, bool) {
+	if len(mi.InfoBytes) == 0 {
+		return "", false
+	}
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return "", false
+	}
+	if info.HasV1() {
+		return mi.HashInfoBytes().HexString(), true
+	}
+	v2 := infohash_v2.HashBytes(mi.InfoBytes)
+	return v2.HexString(), true
+}
@@ -0,0 +1,57 @@
+package confluence
+
+import (
+	"encoding/base32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestParseInfohash(t *testing.T) {
+	var want metainfo.Hash
+	want.FromHexString(testInfohash)
+	for _, s := range []string{
+		testInfohash,
+		strings.ToUpper(testInfohash),
+		base32.StdEncoding.EncodeToString(want[:]),
+		strings.ToLower(base32.StdEncoding.EncodeToString(want[:])),
+		"1114" + testInfohash,
+	} {
+		v1, v2, err := parseInfohash(s)
+		if err != nil || v1 != want || v2.Ok {
+			t.Errorf("%q: %v %v %v", s, v1, v2, err)
+		}
+	}
+	v2Hex := strings.Repeat("ab", 32)
+	for _, s := range []string{v2Hex, "1220" + v2Hex} {
+		v1, v2, err := parseInfohash(s)
+		if err != nil || !v1.IsZero() || !v2.Ok || v2.Value.HexString() != v2Hex {
+			t.Errorf("%q: %v %v %v", s, v1, v2, err)
+		}
+	}
+	for _, bad := range []string{"", "abc", testInfohash + "0", strings.Repeat("zz", 32), "1220" + testInfohash + "0000", strings.Repeat("1", 32)} {
+		_, _, err := parseInfohash(bad)
+		if err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+func TestCanonicalInfohashRedirect(t *testing.T) {
+	var h Handler
+	var ih metainfo.Hash
+	ih.FromHexString(testInfohash)
+	for _, given := range []string{strings.ToUpper(testInfohash), base32.StdEncoding.EncodeToString(ih[:])} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/data/infohash/"+given+"/dir/a%20b?nowait=1", nil))
+		if w.Code != http.StatusPermanentRedirect {
+			t.Fatalf("%v: %v", given, w.Code)
+		}
+		if loc := w.Header().Get("Location"); loc != "/data/infohash/"+testInfohash+"/dir/a%20b?nowait=1" {
+			t.Errorf("%v: redirected to %q", given, loc)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Package testutil has helpers for the tests of confluence and its client, which can't share test
+// files.
+package testutil
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/anacrolix/torrent/types/infohash"
+)
+
+// Returns a torrent Client that doesn't talk to the outside world, its storage, and metainfo
+// storage for a Handler. Everything is kept in temporary directories that are removed when the
+// test completes.
+func HandlerParts(t testing.TB) (cl *torrent.Client, metainfoStorage *MetainfoStorage, storageClient *storage.Client) {
+	// Created before the Client so it's removed after the Client is closed.
+	metainfoStorage = &MetainfoStorage{dir: t.TempDir()}
+	storageImpl := storage.NewFileOpts(storage.NewFileClientOpts{
+		ClientBaseDir:   t.TempDir(),
+		PieceCompletion: storage.NewMapPieceCompletion(),
+	})
+	cfg := torrent.TestingConfig(t)
+	cfg.DefaultStorage = storageImpl
+	cl, err := torrent.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cl.Close()
+		metainfoStorage.close()
+	})
+	storageClient = storage.NewClient(storageImpl)
+	return
+}
+
+// Keeps metainfos in a directory until the test cleans up. Torrents are saved in the background
+// when they get their info or close, which can be after the test completes, so saves after that
+// are dropped rather than racing with the directory's removal.
+type MetainfoStorage struct {
+	dir    string
+	mu     sync.Mutex
+	closed bool
+}
+
+func (me *MetainfoStorage) path(ih infohash.T) string {
+	return filepath.Join(me.dir, ih.HexString()+".torrent")
+}
+
+func (me *MetainfoStorage) Put(ih infohash.T, data []byte) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.closed {
+		return nil
+	}
+	return os.WriteFile(me.path(ih), data, 0o640)
+}
+
+func (me *MetainfoStorage) Get(ih infohash.T) (io.ReadCloser, error) {
+	return os.Open(me.path(ih))
+}
+
+// Waits for saves in progress, and drops later ones.
+func (me *MetainfoStorage) close() {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.closed = true
+}
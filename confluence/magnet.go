@@ -0,0 +1,138 @@
+package confluence
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Resolves the torrent from a magnet link in the "magnet" query parameter. The magnet may give a v1
+// infohash ("urn:btih:"), a v2 infohash ("urn:btmh:", BEP 52), or both for hybrid torrents.
+// Trackers ("tr"), the display name ("dn"), web seeds ("ws"), sources ("xs" and "as") and peer
+// addresses ("x.pe") are merged into the torrent. The exact length ("xl") is checked against the
+// info when it's available, and files selected with "so" (BEP 53) are downloaded. A magnet with a
+// mutable torrent ("xs=urn:btpk:" and "s", BEP 46) instead of an infohash is resolved from the DHT.
+func TorrentFromMagnet(r *http.Request) (ret ResolvedTorrent, err error) {
+	ms := r.URL.Query().Get(magnetQueryKey)
+	if ms == "" {
+		err = fmt.Errorf("expected nonempty query parameter %q", magnetQueryKey)
+		return
+	}
+	m, err := metainfo.ParseMagnetV2Uri(ms)
+	if err != nil {
+		err = fmt.Errorf("parsing magnet: %w", err)
+		return
+	}
+	ret.Mutable, err = magnetMutableTorrent(m.Params)
+	if err != nil {
+		err = fmt.Errorf("parsing magnet mutable torrent: %w", err)
+		return
+	}
+	if !m.InfoHash.Ok && !m.V2InfoHash.Ok && ret.Mutable == nil {
+		err = errors.New("magnet has no btih or btmh infohash, or btpk public key")
+		return
+	}
+	ret.InfoHash = m.InfoHash.Value
+	ret.InfoHashV2 = m.V2InfoHash
+	ret.Spec = magnetSpec(m)
+	if xl := m.Params.Get("xl"); xl != "" {
+		var length int64
+		length, err = strconv.ParseInt(xl, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("parsing magnet exact length: %w", err)
+			return
+		}
+		ret.VerifyInfo = func(info *metainfo.Info) error {
+			if info.TotalLength() != length {
+				return fmt.Errorf("torrent length %v doesn't match magnet exact length %v", info.TotalLength(), length)
+			}
+			return nil
+		}
+	}
+	if so := m.Params["so"]; len(so) != 0 {
+		var selected []fileIndexRange
+		selected, err = parseSelectOnly(so)
+		if err != nil {
+			err = fmt.Errorf("parsing magnet select-only: %w", err)
+			return
+		}
+		ret.AfterAdd = func(t *torrent.Torrent) {
+			go downloadSelectedFiles(t, selected)
+		}
+	}
+	return
+}
+
+func isBtpk(xs string) bool {
+	return strings.HasPrefix(xs, btpkPrefix)
+}
+
+// The parts of a magnet link that can be merged into a torrent.
+func magnetSpec(m metainfo.MagnetV2) *torrent.TorrentSpec {
+	spec := &torrent.TorrentSpec{
+		InfoHash:    m.InfoHash.Value,
+		InfoHashV2:  m.V2InfoHash,
+		DisplayName: m.DisplayName,
+		Webseeds:    m.Params["ws"],
+		Sources:     slices.DeleteFunc(slices.Concat(m.Params["xs"], m.Params["as"]), isBtpk),
+		PeerAddrs:   m.Params["x.pe"],
+	}
+	if len(m.Trackers) != 0 {
+		spec.Trackers = [][]string{m.Trackers}
+	}
+	return spec
+}
+
+// An inclusive range of file indices.
+type fileIndexRange struct {
+	first, last int
+}
+
+// Parses the values of the BEP 53 "so" magnet parameter, such as "0,2,4-6".
+func parseSelectOnly(values []string) (ret []fileIndexRange, err error) {
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			var r fileIndexRange
+			first, last, isRange := strings.Cut(item, "-")
+			r.first, err = strconv.Atoi(first)
+			if err != nil {
+				return
+			}
+			r.last = r.first
+			if isRange {
+				r.last, err = strconv.Atoi(last)
+				if err != nil {
+					return
+				}
+			}
+			if r.first < 0 || r.last < r.first {
+				err = fmt.Errorf("bad file index range %q", item)
+				return
+			}
+			ret = append(ret, r)
+		}
+	}
+	return
+}
+
+func downloadSelectedFiles(t *torrent.Torrent, selected []fileIndexRange) {
+	select {
+	case <-t.GotInfo():
+	case <-t.Closed():
+		return
+	}
+	for i, f := range t.Files() {
+		for _, r := range selected {
+			if i >= r.first && i <= r.last {
+				f.Download()
+				break
+			}
+		}
+	}
+}
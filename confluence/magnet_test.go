@@ -0,0 +1,111 @@
+package confluence
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func magnetRequest(target, magnet string) *http.Request {
+	return httptest.NewRequest(http.MethodGet, target+"?"+url.Values{magnetQueryKey: {magnet}}.Encode(), nil)
+}
+
+func TestTorrentFromMagnetParams(t *testing.T) {
+	const magnet = "magnet:?xt=urn:btih:" + testInfohash +
+		"&dn=sintel&tr=http://tracker.example/announce&ws=http://seed.example/&x.pe=127.0.0.1:6881" +
+		"&xl=10&so=0,2-3"
+	rt, err := TorrentFromMagnet(magnetRequest("/", magnet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.InfoHash.HexString() != testInfohash {
+		t.Fatal(rt.InfoHash)
+	}
+	spec := rt.Spec
+	if spec.DisplayName != "sintel" {
+		t.Errorf("display name %q", spec.DisplayName)
+	}
+	if len(spec.Trackers) != 1 || !slices.Equal(spec.Trackers[0], []string{"http://tracker.example/announce"}) {
+		t.Errorf("trackers %q", spec.Trackers)
+	}
+	if !slices.Equal(spec.Webseeds, []string{"http://seed.example/"}) {
+		t.Errorf("web seeds %q", spec.Webseeds)
+	}
+	if !slices.Equal(spec.PeerAddrs, []string{"127.0.0.1:6881"}) {
+		t.Errorf("peer addrs %q", spec.PeerAddrs)
+	}
+	if rt.AfterAdd == nil {
+		t.Error("selected files not applied")
+	}
+	if rt.VerifyInfo(&metainfo.Info{Length: 10}) != nil {
+		t.Error("matching length rejected")
+	}
+	if rt.VerifyInfo(&metainfo.Info{Length: 11}) == nil {
+		t.Error("mismatched length accepted")
+	}
+}
+
+func TestParseSelectOnly(t *testing.T) {
+	ranges, err := parseSelectOnly([]string{"0,2,4-6", "9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ranges, []fileIndexRange{{0, 0}, {2, 2}, {4, 6}, {9, 9}}) {
+		t.Fatal(ranges)
+	}
+	for _, bad := range []string{"", "a", "3-1", "-1", "1-"} {
+		_, err := parseSelectOnly([]string{bad})
+		if err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+// Magnet trackers go through ModifyTorrentSpec, so a policy like overriding trackers applies.
+func TestMagnetTrackerPolicy(t *testing.T) {
+	for _, override := range []bool{false, true} {
+		h := testingHandler(t)
+		h.ModifyTorrentSpec = func(spec *torrent.TorrentSpec) {
+			if override {
+				spec.Trackers = nil
+			}
+		}
+		const magnet = "magnet:?xt=urn:btih:" + testInfohash + "&tr=http://tracker.example/announce"
+		r := magnetRequest("/info", magnet)
+		r.URL.RawQuery += "&nowait=1"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusAccepted {
+			t.Fatal(w.Code)
+		}
+		var ih metainfo.Hash
+		ih.FromHexString(testInfohash)
+		tor, ok := h.TC.Torrent(ih)
+		if !ok {
+			t.Fatal("torrent not added")
+		}
+		mi := tor.Metainfo()
+		hasTracker := len(mi.UpvertedAnnounceList().DistinctValues()) != 0
+		if hasTracker == override {
+			t.Errorf("override=%v: has tracker=%v", override, hasTracker)
+		}
+	}
+}
+
+func TestMagnetExactLengthMismatch(t *testing.T) {
+	h := testingHandler(t)
+	ih := testUpload(t, h, "test", map[string]string{"a": "hello"})
+	for xl, status := range map[string]int{"5": http.StatusOK, "6": http.StatusConflict} {
+		magnet := "magnet:?xt=urn:btih:" + ih.HexString() + "&xl=" + xl
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, magnetRequest("/data", magnet))
+		if w.Code != status {
+			t.Errorf("xl=%v: got status %v", xl, w.Code)
+		}
+	}
+}
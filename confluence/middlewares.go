@@ -11,17 +11,32 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"strings"
+	"sync"
 	"time"
 
+	g "github.com/anacrolix/generics"
 	"github.com/anacrolix/squirrel"
 	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/metainfo"
+	infohash_v2 "github.com/anacrolix/torrent/types/infohash-v2"
 )
 
+// Adds the torrent to the Client if it's not already present, and returns it with a reference held.
+// Call release when done; extra calls are no-ops.
+// When the last reference to a torrent is released, OnTorrentGrace is called after TorrentGrace.
+// The torrent's cached metainfo isn't applied, use WithTorrent for that.
 func (h *Handler) GetTorrent(ih metainfo.Hash) (t *torrent.Torrent, new bool, release func()) {
+	return h.getTorrent(torrent.AddTorrentOpts{InfoHash: ih})
+}
+
+// Like GetTorrent, but the torrent may be identified by its v2 infohash.
+func (h *Handler) getTorrent(opts torrent.AddTorrentOpts) (t *torrent.Torrent, new bool, release func()) {
+	ih := opts.InfoHash
+	if ih.IsZero() {
+		ih = *opts.InfoHashV2.Value.ToShort()
+	}
 	ref := h.torrentRefs.NewRef(ih)
-	t, new = h.TC.AddTorrentInfoHash(ih)
+	t, new = h.TC.AddTorrentOpt(opts)
 	// log.Printf("added ref for %v", ih)
 	ref.SetCloser(func() {
 		// log.Printf("running torrent ref closer for %v", ih)
@@ -29,9 +44,12 @@ func (h *Handler) GetTorrent(ih metainfo.Hash) (t *torrent.Torrent, new bool, re
 			h.OnTorrentGrace(t)
 		}
 	})
+	var releaseOnce sync.Once
 	release = func() {
-		// log.Printf("releasing ref on %v", ih)
-		time.AfterFunc(h.TorrentGrace, ref.Release)
+		releaseOnce.Do(func() {
+			// log.Printf("releasing ref on %v", ih)
+			time.AfterFunc(h.TorrentGrace, ref.Release)
+		})
 	}
 	return
 }
@@ -41,96 +59,184 @@ const (
 	magnetQueryKey   = "magnet"
 )
 
-type request struct {
-	torrent *torrent.Torrent
-	handler *Handler
+// A request for a handler that operates on a torrent. See Handler.WithTorrent.
+type TorrentRequest struct {
 	*http.Request
+	// A reference to the Torrent is held until the handler returns. To use it after that, such as
+	// from another goroutine, obtain another reference with Handler.GetTorrent.
+	Torrent *torrent.Torrent
+	// The Handler serving the request.
+	Handler *Handler
+	// From ResolvedTorrent.VerifyInfo.
+	verifyInfo func(info *metainfo.Info) error
 }
 
-func (me *Handler) withTorrentContextFromQuery(h func(w http.ResponseWriter, r *request)) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		me.withTorrentContext(h, func() (ih metainfo.Hash, err error, afterAdd func(t *torrent.Torrent)) {
-			q := r.URL.Query()
-			ms := q.Get("magnet")
-			if ms != "" {
-				m, err := metainfo.ParseMagnetUri(ms)
-				if err != nil {
-					return metainfo.Hash{}, fmt.Errorf("parsing magnet: %w", err), nil
-				}
-				return m.InfoHash, nil, func(t *torrent.Torrent) {
-					ts := [][]string{m.Trackers}
-					// TODO: This bypasses OnNewTorrent, and the override trackers flag.
-					// log.Printf("adding trackers %v", ts)
-					t.AddTrackers(ts)
-				}
-			}
-			if ihqv := q.Get(infohashQueryKey); ihqv != "" {
-				err = ih.FromHexString(q.Get(infohashQueryKey))
-				return
-			}
-			err = fmt.Errorf("expected nonempty query parameter %q or %q", magnetQueryKey, infohashQueryKey)
-			return
-		}).ServeHTTP(w, r)
-	})
+// What a TorrentResolver determined about the torrent for a request.
+type ResolvedTorrent struct {
+	// The v1 infohash. It may be zero if InfoHashV2 is set.
+	InfoHash metainfo.Hash
+	// The v2 infohash (BEP 52), if known.
+	InfoHashV2 g.Option[infohash_v2.T]
+	// Extra metadata implied by the request, such as from a magnet link. It's merged into the
+	// torrent by the same process as cached metainfos, see Handler.ModifyTorrentSpec.
+	Spec *torrent.TorrentSpec
+	// Called with the torrent after it's added, and Spec is merged. Note that the torrent may be
+	// released as soon as the request is complete.
+	AfterAdd func(t *torrent.Torrent)
+	// Checks the torrent info is consistent with the request, once it's available.
+	VerifyInfo func(info *metainfo.Info) error
+	// If no infohash is given, the torrent is the current one for this mutable torrent, which is
+	// looked up in the DHT.
+	Mutable *MutableTorrent
 }
 
-// Determines intended torrent for a request, and any extra behaviour that can be implied when
+// The infohash the torrent is known by in the Client and the metainfo cache. This is the truncated
+// v2 infohash for v2-only torrents.
+func (me *ResolvedTorrent) shortInfohash() metainfo.Hash {
+	if me.InfoHash.IsZero() && me.InfoHashV2.Ok {
+		return *me.InfoHashV2.Value.ToShort()
+	}
+	return me.InfoHash
+}
+
+// Determines the intended torrent for a request, and any extra behaviour that can be implied when
 // adding it to the torrent Client, such as trackers and other metadata in a magnet link.
-type torrentContextGetter func() (ih metainfo.Hash, err error, afterAdd func(t *torrent.Torrent))
+type TorrentResolver func(r *http.Request) (ResolvedTorrent, error)
 
-// Returns a middleware that calls in to a handler that expects a Torrent.
-func (me *Handler) withTorrentContext(h func(w http.ResponseWriter, r *request), getTorrent torrentContextGetter) http.Handler {
+// Resolves the torrent from the "magnet" query parameter if present, and otherwise the "ih" query
+// parameter.
+func TorrentFromQuery(r *http.Request) (ResolvedTorrent, error) {
+	q := r.URL.Query()
+	if q.Get(magnetQueryKey) != "" {
+		return TorrentFromMagnet(r)
+	}
+	if q.Get(infohashQueryKey) != "" {
+		return TorrentFromInfohashQuery(r)
+	}
+	return ResolvedTorrent{}, fmt.Errorf("expected nonempty query parameter %q or %q", magnetQueryKey, infohashQueryKey)
+}
+
+// Resolves the torrent from the infohash in the "ih" query parameter. See parseInfohash for the
+// accepted forms.
+func TorrentFromInfohashQuery(r *http.Request) (ret ResolvedTorrent, err error) {
+	ihqv := r.URL.Query().Get(infohashQueryKey)
+	if ihqv == "" {
+		err = fmt.Errorf("expected nonempty query parameter %q", infohashQueryKey)
+		return
+	}
+	ret.InfoHash, ret.InfoHashV2, err = parseInfohash(ihqv)
+	return
+}
+
+// The name of the wildcard in route patterns that holds the infohash, for use with
+// TorrentFromInfohashPath.
+const InfohashPathWildcard = "ih"
+
+// Resolves the torrent from the infohash in the "{ih}" wildcard in the route pattern. See
+// parseInfohash for the accepted forms.
+func TorrentFromInfohashPath(r *http.Request) (ret ResolvedTorrent, err error) {
+	ret.InfoHash, ret.InfoHashV2, err = parseInfohash(r.PathValue(InfohashPathWildcard))
+	return
+}
+
+// Returns an http.Handler that determines the torrent for the request with resolve, and calls h
+// with it. Mutable torrents are resolved to their current infohash. The torrent is added to the
+// Client if necessary, with its cached metainfo and OnNewTorrent applied. A reference to the
+// torrent is held while h runs, and is released when it returns, including if it panics. If
+// resolve fails, h isn't called, and no torrent is added.
+func (me *Handler) WithTorrent(resolve TorrentResolver, h func(w http.ResponseWriter, r *TorrentRequest)) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ih, err, afterAdd := getTorrent()
+		rt, err := resolve(r)
+		if ih := rt.shortInfohash(); err == nil && ih.IsZero() && rt.Mutable != nil {
+			var status int
+			var resolveErr *Error
+			rt.InfoHash, rt.InfoHashV2, status, resolveErr = me.resolveMutableTorrent(r.Context(), *rt.Mutable)
+			if resolveErr != nil {
+				writeError(w, r, status, resolveErr)
+				return
+			}
+		}
+		ih := rt.shortInfohash()
+		if err == nil && ih.IsZero() {
+			err = errors.New("no infohash")
+		}
 		if err != nil {
-			http.Error(w, fmt.Errorf("error determining requested infohash: %w", err).Error(), http.StatusBadRequest)
+			httpError(w, r, http.StatusBadRequest, ErrorCodeBadInfohash, fmt.Errorf("error determining requested infohash: %w", err).Error())
 			return
 		}
-		t, new, release := me.GetTorrent(ih)
+		t, new, release := me.getTorrent(torrent.AddTorrentOpts{
+			InfoHash:   rt.InfoHash,
+			InfoHashV2: rt.InfoHashV2,
+		})
 		defer release()
 		if new {
-			mi, err := me.cachedMetaInfo(ih)
+			err := me.applyCachedMetaInfo(t, ih)
 			if err != nil {
-				log.Printf("error getting cached metainfo for %q: %v", ih, err)
-			}
-			if mi != nil {
-				t.SetInfoBytes(mi.InfoBytes)
-			}
-			if me.OnNewTorrent != nil {
-				me.OnNewTorrent(t, mi)
-			} else if mi != nil {
-				spec, _ := torrent.TorrentSpecFromMetaInfoErr(mi)
-				t.MergeSpec(spec)
+				// Dropped, so the next request tries again rather than getting a torrent without
+				// its info.
+				t.Drop()
+				torrentError(w, r, t, http.StatusInternalServerError, ErrorCodeInternal, fmt.Sprintf("error applying cached metainfo: %v", err))
+				return
 			}
 			go me.saveTorrentWhenGotInfo(t)
 		}
-		if afterAdd != nil {
-			afterAdd(t)
+		if rt.Spec != nil {
+			err := me.mergeSpec(t, rt.Spec)
+			if err != nil {
+				torrentError(w, r, t, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("error merging torrent spec: %v", err))
+				return
+			}
+		}
+		if rt.AfterAdd != nil {
+			rt.AfterAdd(t)
 		}
 		me.saveTorrentFile(t)
-		h(w, &request{t, me, r})
+		h(w, &TorrentRequest{r, t, me, rt.VerifyInfo})
 	})
 }
 
-func (me *Handler) withTorrentContextFromInfohashPath(h func(http.ResponseWriter, *request)) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		me.withTorrentContext(h, func() (ih metainfo.Hash, err error, afterAdd func(t *torrent.Torrent)) {
-			p := r.URL.Path
-			start := 1 // path should always start with /
-			end := strings.IndexByte(p[start:], '/')
-			if end == -1 {
-				// There's no next path segment, that might be okay.
-				end = len(p)
-			} else {
-				end += start
-			}
-			err = ih.FromHexString(p[start:end])
-			// Note that we're modifying our caller's Request, and not modifying RawPath, both of
-			// which could be dangerous.
-			r.URL.Path = p[end:]
-			return
-		}).ServeHTTP(w, r)
-	})
+// Sets up a torrent that was just added from its cached metainfo, if there is one, with
+// OnNewTorrent or mergeSpec.
+func (h *Handler) applyCachedMetaInfo(t *torrent.Torrent, ih metainfo.Hash) error {
+	mi, err := h.cachedMetaInfo(ih)
+	if err != nil {
+		log.Printf("error getting cached metainfo for %q: %v", ih, err)
+	}
+	if mi != nil {
+		err = t.SetInfoBytes(mi.InfoBytes)
+		if err != nil {
+			return fmt.Errorf("setting info bytes: %w", err)
+		}
+	}
+	if h.OnNewTorrent != nil {
+		h.OnNewTorrent(t, mi)
+		return nil
+	}
+	if mi == nil {
+		return nil
+	}
+	spec, err := torrent.TorrentSpecFromMetaInfoErr(mi)
+	if err != nil {
+		return err
+	}
+	return h.mergeSpec(t, spec)
+}
+
+// Merges the spec into the torrent after applying ModifyTorrentSpec. Web seeds are added with
+// AddWebseeds.
+func (h *Handler) mergeSpec(t *torrent.Torrent, spec *torrent.TorrentSpec) error {
+	if h.ModifyTorrentSpec != nil {
+		h.ModifyTorrentSpec(spec)
+	}
+	webseeds := spec.Webseeds
+	spec.Webseeds = nil
+	err := t.MergeSpec(spec)
+	spec.Webseeds = webseeds
+	if err != nil {
+		return err
+	}
+	h.AddWebseeds(t, webseeds)
+	return nil
 }
 
 func (h *Handler) saveTorrentWhenGotInfo(t *torrent.Torrent) {
@@ -0,0 +1,150 @@
+package confluence
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+const testInfohash = "0123456789abcdef0123456789abcdef01234567"
+
+// Returns a handler that reports torrents as their last reference is released.
+func newGraceTestHandler(t *testing.T) (*Handler, chan metainfo.Hash) {
+	h := testingHandler(t)
+	graced := make(chan metainfo.Hash, 10)
+	h.OnTorrentGrace = func(t *torrent.Torrent) {
+		graced <- t.InfoHash()
+	}
+	return h, graced
+}
+
+func expectGrace(t *testing.T, graced chan metainfo.Hash) {
+	t.Helper()
+	select {
+	case ih := <-graced:
+		if ih.HexString() != testInfohash {
+			t.Fatalf("unexpected torrent released: %v", ih)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("torrent reference wasn't released")
+	}
+}
+
+func expectNoGrace(t *testing.T, graced chan metainfo.Hash) {
+	t.Helper()
+	select {
+	case ih := <-graced:
+		t.Fatalf("torrent %v released unexpectedly", ih)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWithTorrentReleasesAfterHandler(t *testing.T) {
+	h, graced := newGraceTestHandler(t)
+	handler := h.WithTorrent(TorrentFromInfohashQuery, func(w http.ResponseWriter, r *TorrentRequest) {
+		if r.Torrent.InfoHash().HexString() != testInfohash {
+			t.Errorf("unexpected torrent %v", r.Torrent.InfoHash())
+		}
+		expectNoGrace(t, graced)
+	})
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?ih="+testInfohash, nil))
+	expectGrace(t, graced)
+	expectNoGrace(t, graced)
+}
+
+// The torrent isn't released until the last concurrent request for it is done.
+func TestWithTorrentConcurrentRequests(t *testing.T) {
+	h, graced := newGraceTestHandler(t)
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	blocking := h.WithTorrent(TorrentFromInfohashQuery, func(w http.ResponseWriter, r *TorrentRequest) {
+		close(entered)
+		<-unblock
+	})
+	quick := h.WithTorrent(TorrentFromInfohashQuery, func(w http.ResponseWriter, r *TorrentRequest) {})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		blocking.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?ih="+testInfohash, nil))
+	}()
+	<-entered
+	quick.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?ih="+testInfohash, nil))
+	expectNoGrace(t, graced)
+	close(unblock)
+	<-done
+	expectGrace(t, graced)
+	expectNoGrace(t, graced)
+}
+
+func TestWithTorrentReleasesOnPanic(t *testing.T) {
+	h, graced := newGraceTestHandler(t)
+	handler := h.WithTorrent(TorrentFromInfohashQuery, func(w http.ResponseWriter, r *TorrentRequest) {
+		panic(http.ErrAbortHandler)
+	})
+	func() {
+		defer func() {
+			if recover() != http.ErrAbortHandler {
+				t.Error("expected handler panic")
+			}
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?ih="+testInfohash, nil))
+	}()
+	expectGrace(t, graced)
+}
+
+func TestWithTorrentResolveError(t *testing.T) {
+	h, graced := newGraceTestHandler(t)
+	handler := h.WithTorrent(TorrentFromMagnet, func(w http.ResponseWriter, r *TorrentRequest) {
+		t.Error("handler called")
+	})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?ih="+testInfohash, nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatal(w.Code)
+	}
+	if n := len(h.TC.Torrents()); n != 0 {
+		t.Fatalf("%v torrents added", n)
+	}
+	expectNoGrace(t, graced)
+}
+
+func TestGetTorrentReleaseIdempotent(t *testing.T) {
+	h, graced := newGraceTestHandler(t)
+	var ih metainfo.Hash
+	ih.FromHexString(testInfohash)
+	_, _, release := h.GetTorrent(ih)
+	release()
+	release()
+	expectGrace(t, graced)
+	expectNoGrace(t, graced)
+}
+
+// A cached metainfo that can't be applied fails the request, rather than giving the handler a
+// torrent without its info.
+func TestWithTorrentBadCachedMetainfo(t *testing.T) {
+	h := testingHandler(t)
+	var ih metainfo.Hash
+	ih.FromHexString(testInfohash)
+	// The info isn't a dict.
+	mi, err := bencode.Marshal(metainfo.MetaInfo{InfoBytes: bencode.Bytes("i1e")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.MetainfoStorageInterface.Put(ih, mi)
+	handler := h.WithTorrent(TorrentFromQuery, func(w http.ResponseWriter, r *TorrentRequest) {
+		t.Error("handler called")
+	})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?ih="+testInfohash, nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("%v %q", w.Code, w.Body.String())
+	}
+	if n := len(h.TC.Torrents()); n != 0 {
+		t.Fatalf("%v torrents left in the client", n)
+	}
+}
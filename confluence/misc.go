@@ -2,6 +2,9 @@ package confluence
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
@@ -12,8 +15,10 @@ import (
 	"github.com/anacrolix/missinggo/v2"
 	"github.com/anacrolix/missinggo/v2/httptoo"
 	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
 	"github.com/anacrolix/torrent/metainfo"
 	"github.com/anacrolix/torrent/types/infohash"
+	infohash_v2 "github.com/anacrolix/torrent/types/infohash-v2"
 )
 
 // Path is the given request path.
@@ -30,19 +35,56 @@ func (h *Handler) saveTorrentFile(t *torrent.Torrent) error {
 	return h.saveMetaInfo(t.Metainfo(), t.InfoHash())
 }
 
-// Take info-hash separately in case we don't have the info-bytes.
+// Take info-hash separately in case we don't have the info-bytes. If we do, the metainfo is also
+// saved under the other infohashes they imply, so hybrid torrents can be found by either.
 func (h *Handler) saveMetaInfo(mi metainfo.MetaInfo, ih infohash.T) error {
 	var miBuf bytes.Buffer
 	err := mi.Write(&miBuf)
 	if err != nil {
 		return err
 	}
+	ihs := []infohash.T{ih}
+	for _, other := range infoBytesShortHashes(mi.InfoBytes) {
+		if other != ih {
+			ihs = append(ihs, other)
+		}
+	}
+	for _, ih := range ihs {
+		err = h.putMetaInfo(ih, miBuf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The v1 infohash and truncated v2 infohash that apply to info bytes, as torrents are keyed in the
+// Client.
+func infoBytesShortHashes(infoBytes []byte) (ret []infohash.T) {
+	if len(infoBytes) == 0 {
+		return
+	}
+	var info metainfo.Info
+	if bencode.Unmarshal(infoBytes, &info) != nil {
+		return
+	}
+	if info.HasV1() {
+		ret = append(ret, infohash.HashBytes(infoBytes))
+	}
+	if info.HasV2() {
+		v2 := infohash_v2.HashBytes(infoBytes)
+		ret = append(ret, *v2.ToShort())
+	}
+	return
+}
+
+func (h *Handler) putMetaInfo(ih infohash.T, b []byte) error {
 	if h.MetainfoStorageInterface != nil {
-		return h.MetainfoStorageInterface.Put(ih, miBuf.Bytes())
+		return h.MetainfoStorageInterface.Put(ih, b)
 	}
 	key := path.Join(h.metainfoCacheDir(), ih.HexString()+".torrent")
 	if h.MetainfoStorage != nil {
-		return h.MetainfoStorage.Put(key, miBuf.Bytes())
+		return h.MetainfoStorage.Put(key, b)
 	}
 	fp := filepath.FromSlash(key)
 	os.MkdirAll(filepath.Dir(fp), 0o750)
@@ -51,7 +93,7 @@ func (h *Handler) saveMetaInfo(mi metainfo.MetaInfo, ih infohash.T) error {
 		return err
 	}
 	defer f.Close()
-	_, err = f.Write(miBuf.Bytes())
+	_, err = f.Write(b)
 	if err != nil {
 		return err
 	}
@@ -87,15 +129,114 @@ func ServeTorrentReader(w http.ResponseWriter, r *http.Request, tr torrent.Reade
 func ServeFile(w http.ResponseWriter, r *http.Request, t *torrent.Torrent, _path string) {
 	select {
 	case <-r.Context().Done():
-		http.Error(w, "request canceled", httptoo.StatusClientCancelledRequest)
+		torrentError(w, r, t, httptoo.StatusClientCancelledRequest, ErrorCodeRequestCanceled, "request canceled")
 		return
 	case <-t.GotInfo():
 	}
 	tf := torrentFileByPath(t, _path)
 	if tf == nil {
-		http.Error(w, "file not found", http.StatusNotFound)
+		torrentError(w, r, t, http.StatusNotFound, ErrorCodeFileNotFound, "file not found")
 		return
 	}
 	// w.Header().Set("ETag", httptoo.EncodeQuotedString(fmt.Sprintf("%s/%s", t.InfoHash().HexString(), _path)))
-	ServeTorrentReader(w, r, tf.NewReader(), _path)
+	serveTorrentFile(w, r, t, tf, _path)
+}
+
+func serveTorrentFile(w http.ResponseWriter, r *http.Request, t *torrent.Torrent, tf *torrent.File, name string) {
+	if tf.Offset()+tf.Length() > t.Length() {
+		http.ServeContent(w, r, name, time.Time{}, &alignedFileReader{ctx: r.Context(), t: t, f: tf})
+		return
+	}
+	ServeTorrentReader(w, r, tf.NewReader(), name)
+}
+
+// Reads a file in a torrent with piece-aligned files (BEP 52) directly from piece storage. The
+// torrent package's readers bound torrent offsets by the sum of the file lengths, which doesn't
+// include the alignment gaps, so files that end beyond that can't be read with them.
+type alignedFileReader struct {
+	ctx context.Context
+	t   *torrent.Torrent
+	f   *torrent.File
+	pos int64
+}
+
+func (me *alignedFileReader) Read(b []byte) (n int, err error) {
+	if me.pos >= me.f.Length() {
+		return 0, io.EOF
+	}
+	off := me.f.Offset() + me.pos
+	pieceLength := me.t.Info().PieceLength
+	p := me.t.Piece(int(off / pieceLength))
+	err = waitPieceComplete(me.ctx, me.t, p)
+	if err != nil {
+		return
+	}
+	b = b[:min(int64(len(b)), me.f.Length()-me.pos, pieceLength-off%pieceLength)]
+	n, err = p.Storage().ReadAt(b, off%pieceLength)
+	me.pos += int64(n)
+	if err == io.EOF && n != 0 {
+		err = nil
+	}
+	return
+}
+
+func (me *alignedFileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += me.pos
+	case io.SeekEnd:
+		offset += me.f.Length()
+	default:
+		return me.pos, fmt.Errorf("bad whence %v", whence)
+	}
+	if offset < 0 {
+		return me.pos, errors.New("negative position")
+	}
+	me.pos = offset
+	return offset, nil
+}
+
+// Waits for the piece to be complete, prioritizing it in the meantime. The priority comes from a
+// reader over the piece, so it ends with the wait without affecting priorities set elsewhere.
+func waitPieceComplete(ctx context.Context, t *torrent.Torrent, p *torrent.Piece) error {
+	if p.State().Complete {
+		return nil
+	}
+	info := p.Info()
+	if info.Offset() >= t.Length() {
+		// Readers can't reach pieces after the alignment gaps of piece-aligned files (see
+		// alignedFileReader), so the piece is only ever raised to a normal priority.
+		t.DownloadPieces(info.Index(), info.Index()+1)
+		return waitPieceState(ctx, t, p)
+	}
+	r := t.NewReader()
+	defer r.Close()
+	r.SetReadahead(info.Length())
+	_, err := r.Seek(info.Offset(), io.SeekStart)
+	if err != nil {
+		return err
+	}
+	// Readers only return data from complete pieces.
+	n, err := r.ReadContext(ctx, make([]byte, 1))
+	if n != 0 {
+		return nil
+	}
+	return err
+}
+
+// Waits for the piece to be complete, without prioritizing it.
+func waitPieceState(ctx context.Context, t *torrent.Torrent, p *torrent.Piece) error {
+	sub := t.SubscribePieceStateChanges()
+	defer sub.Close()
+	for !p.State().Complete {
+		select {
+		case <-sub.Values:
+		case <-t.Closed():
+			return errors.New("torrent closed")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
 }
@@ -1,11 +1,12 @@
 package confluence
 
 import (
-	"io"
+	"fmt"
 	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/anacrolix/log"
-	"github.com/anacrolix/missinggo/v2/httptoo"
 )
 
 func (h *Handler) init() {
@@ -14,25 +15,66 @@ func (h *Handler) init() {
 			h.Logger = &log.Default
 		}
 		h.Logger.Levelf(log.Debug, "initing handler %p", h)
-		mux := &h.mux
-		mux.Handle("/data", h.withTorrentContextFromQuery(dataQueryHandler))
-		mux.Handle("/data/infohash/", http.StripPrefix(
-			"/data/infohash",
-			h.withTorrentContextFromInfohashPath(dataPathHandler)))
-		mux.HandleFunc("/status", h.statusHandler)
-		mux.Handle("/info", h.withTorrentContextFromQuery(infoHandler))
-		mux.Handle("/events", h.withTorrentContextFromQuery(eventHandler))
-		mux.Handle("/fileState", h.withTorrentContextFromQuery(func(w http.ResponseWriter, r *request) {
-			httptoo.GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, hr *http.Request) {
-				r.Request = hr
-				fileStateHandler(w, r)
-			})).ServeHTTP(w, r.Request)
+		allowed := make(map[string][]string)
+		// Patterns in the order they're first seen, so registration is deterministic.
+		var patterns []string
+		for _, r := range append(h.routes(), h.ExtraRoutes...) {
+			h.handle(r)
+			if _, ok := allowed[r.Pattern]; !ok {
+				patterns = append(patterns, r.Pattern)
+			}
+			allowed[r.Pattern] = append(allowed[r.Pattern], r.Methods...)
+		}
+		for _, p := range patterns {
+			h.muxHandle(p, methodNotAllowedHandler(allowed[p]))
+		}
+		h.muxHandle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			httpError(w, r, http.StatusNotFound, ErrorCodeNotFound, "404 page not found")
 		}))
-		mux.HandleFunc("/metainfo", h.metainfoHandler)
-		mux.HandleFunc("/bep44", h.handleBep44)
-		mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-			h.TC.WriteStatus(io.Discard)
-		})
-		mux.HandleFunc("/upload", h.uploadHandler)
+	})
+}
+
+// Registers the route for each of its methods, and includes it in the OpenAPI spec.
+func (h *Handler) handle(r Route) {
+	if len(r.Methods) == 0 {
+		panic(fmt.Sprintf("route %q has no methods", r.Pattern))
+	}
+	var handler http.Handler
+	if r.Torrent != nil {
+		if r.TorrentHandler == nil {
+			panic(fmt.Sprintf("route %q resolves a torrent but has no TorrentHandler", r.Pattern))
+		}
+		handler = h.WithTorrent(r.Torrent, r.TorrentHandler)
+	} else {
+		if r.Handler == nil {
+			panic(fmt.Sprintf("route %q has no Handler", r.Pattern))
+		}
+		handler = r.Handler
+	}
+	for i := len(r.Middlewares) - 1; i >= 0; i-- {
+		handler = r.Middlewares[i](handler)
+	}
+	for _, m := range r.Methods {
+		h.muxHandle(m+" "+r.Pattern, handler)
+	}
+	h.registeredRoutes = append(h.registeredRoutes, r)
+}
+
+func (h *Handler) muxHandle(pattern string, handler http.Handler) {
+	h.mux.Handle(pattern, handler)
+	h.muxPatterns = append(h.muxPatterns, pattern)
+}
+
+// Handles requests that matched a route's pattern, but none of its methods.
+func methodNotAllowedHandler(methods []string) http.Handler {
+	methods = slices.Clone(methods)
+	if slices.Contains(methods, http.MethodGet) && !slices.Contains(methods, http.MethodHead) {
+		methods = append(methods, http.MethodHead)
+	}
+	allow := strings.Join(methods, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		httpError(w, r, http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed,
+			fmt.Sprintf("method %v not allowed, expected one of %v", r.Method, allow))
 	})
 }
@@ -0,0 +1,220 @@
+package confluence
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A subset of the OpenAPI 3 document structure, sufficient to describe Handler's routes.
+
+type openApiDocument struct {
+	OpenApi    string                     `json:"openapi"`
+	Info       openApiInfo                `json:"info"`
+	Paths      map[string]openApiPathItem `json:"paths"`
+	Components openApiComponents          `json:"components"`
+}
+
+type openApiInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// Operations keyed by lower-case method.
+type openApiPathItem map[string]openApiOperation
+
+type openApiOperation struct {
+	Summary     string                     `json:"summary"`
+	Description string                     `json:"description,omitempty"`
+	Parameters  []openApiParameter         `json:"parameters,omitempty"`
+	RequestBody *openApiRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openApiResponse `json:"responses"`
+}
+
+type openApiParameter struct {
+	Name        string        `json:"name"`
+	In          string        `json:"in"`
+	Required    bool          `json:"required,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Schema      openApiSchema `json:"schema"`
+}
+
+type openApiRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openApiMediaType `json:"content"`
+}
+
+type openApiResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openApiMediaType `json:"content,omitempty"`
+}
+
+type openApiMediaType struct {
+	Schema openApiSchema `json:"schema"`
+}
+
+type openApiSchema struct {
+	Ref        string                   `json:"$ref,omitempty"`
+	Type       string                   `json:"type,omitempty"`
+	Format     string                   `json:"format,omitempty"`
+	Enum       []string                 `json:"enum,omitempty"`
+	Properties map[string]openApiSchema `json:"properties,omitempty"`
+	Required   []string                 `json:"required,omitempty"`
+}
+
+type openApiComponents struct {
+	Schemas map[string]openApiSchema `json:"schemas"`
+}
+
+func errorSchema() openApiSchema {
+	codes := make([]string, 0, len(errorCodes))
+	for c := range errorCodes {
+		codes = append(codes, string(c))
+	}
+	slices.Sort(codes)
+	return openApiSchema{
+		Type: "object",
+		Properties: map[string]openApiSchema{
+			"code":      {Type: "string", Enum: codes},
+			"message":   {Type: "string"},
+			"infohash":  {Type: "string"},
+			"retryable": {Type: "boolean"},
+		},
+		Required: []string{"code", "message", "retryable"},
+	}
+}
+
+// The version of this module, as best as can be determined from the build.
+func moduleVersion() string {
+	const modulePath = "github.com/anacrolix/confluence"
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if bi.Main.Path == modulePath {
+		return bi.Main.Version
+	}
+	for _, dep := range bi.Deps {
+		if dep.Path == modulePath {
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+func mediaTypeContent(contentType string) map[string]openApiMediaType {
+	if contentType == "" {
+		return nil
+	}
+	schema := openApiSchema{Type: "string"}
+	switch contentType {
+	case jsonContentType:
+		schema = openApiSchema{}
+	case textContentType:
+	default:
+		schema.Format = "binary"
+	}
+	return map[string]openApiMediaType{contentType: {Schema: schema}}
+}
+
+// Converts a ServeMux pattern to an OpenAPI path template, and returns the names of its wildcards.
+func openApiPath(pattern string) (path string, wildcards []string) {
+	segments := strings.Split(pattern, "/")
+	for i, seg := range segments {
+		name, ok := strings.CutPrefix(seg, "{")
+		if !ok {
+			continue
+		}
+		name = strings.TrimSuffix(name, "}")
+		name = strings.TrimSuffix(name, "...")
+		if name == "$" {
+			segments[i] = ""
+			continue
+		}
+		wildcards = append(wildcards, name)
+		segments[i] = "{" + name + "}"
+	}
+	path = strings.Join(segments, "/")
+	return
+}
+
+func (doc RouteDoc) openApi(pathWildcards []string) (ret openApiOperation) {
+	ret.Summary = doc.Summary
+	ret.Description = doc.Description
+	params := doc.Params
+	for _, w := range pathWildcards {
+		if !slices.ContainsFunc(params, func(p ParamDoc) bool { return p.In == "path" && p.Name == w }) {
+			params = append(params, ParamDoc{Name: w, In: "path", Required: true})
+		}
+	}
+	for _, p := range params {
+		ret.Parameters = append(ret.Parameters, openApiParameter{
+			Name:        p.Name,
+			In:          p.In,
+			Required:    p.Required,
+			Description: p.Description,
+			Schema:      openApiSchema{Type: "string"},
+		})
+	}
+	if doc.RequestBody != "" {
+		ret.RequestBody = &openApiRequestBody{
+			Required: true,
+			Content:  mediaTypeContent(doc.RequestBody),
+		}
+	}
+	ret.Responses = make(map[string]openApiResponse, len(doc.Responses)+1)
+	for _, r := range doc.Responses {
+		ret.Responses[strconv.Itoa(r.Status)] = openApiResponse{
+			Description: r.Description,
+			Content:     mediaTypeContent(r.ContentType),
+		}
+	}
+	ret.Responses["default"] = openApiResponse{
+		Description: "An error. The body is JSON if requested with Accept, otherwise plain text.",
+		Content: map[string]openApiMediaType{
+			jsonContentType: {Schema: openApiSchema{Ref: "#/components/schemas/Error"}},
+			textContentType: {Schema: openApiSchema{Type: "string"}},
+		},
+	}
+	return
+}
+
+func openApiSpec(routes []Route) openApiDocument {
+	doc := openApiDocument{
+		OpenApi: "3.0.3",
+		Info: openApiInfo{
+			Title:       "confluence",
+			Description: "A BitTorrent client as an HTTP service.",
+			Version:     moduleVersion(),
+		},
+		Paths: make(map[string]openApiPathItem, len(routes)),
+		Components: openApiComponents{
+			Schemas: map[string]openApiSchema{
+				"Error": errorSchema(),
+			},
+		},
+	}
+	for _, r := range routes {
+		path, wildcards := openApiPath(r.Pattern)
+		item := doc.Paths[path]
+		if item == nil {
+			item = make(openApiPathItem)
+			doc.Paths[path] = item
+		}
+		for _, m := range r.Methods {
+			item[strings.ToLower(m)] = r.Doc.openApi(wildcards)
+		}
+	}
+	return doc
+}
+
+func (h *Handler) openApiHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", jsonContentType)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(openApiSpec(h.registeredRoutes))
+}
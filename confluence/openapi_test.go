@@ -0,0 +1,109 @@
+package confluence
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getOpenApiSpec(t *testing.T, h *Handler) (doc openApiDocument) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Code)
+	}
+	err := json.NewDecoder(w.Body).Decode(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// Every pattern and method registered with the mux must be described in the spec it serves.
+func TestOpenApiCoversMux(t *testing.T) {
+	var h Handler
+	doc := getOpenApiSpec(t, &h)
+	if len(h.muxPatterns) == 0 {
+		t.Fatal("no patterns registered")
+	}
+	for _, pattern := range h.muxPatterns {
+		if pattern == "/" {
+			// The catch-all for 404s.
+			continue
+		}
+		method, rest, ok := strings.Cut(pattern, " ")
+		if !ok {
+			// Handles methods the pattern doesn't support, so only the path must be described.
+			method, rest = "", pattern
+		}
+		path, _ := openApiPath(rest)
+		item, ok := doc.Paths[path]
+		if !ok {
+			t.Errorf("pattern %q has no spec entry", pattern)
+			continue
+		}
+		if method == "" {
+			continue
+		}
+		op, ok := item[strings.ToLower(method)]
+		if !ok {
+			t.Errorf("pattern %q has no spec entry for its method", pattern)
+			continue
+		}
+		if op.Summary == "" {
+			t.Errorf("%v %v has no summary", method, path)
+		}
+		if len(op.Responses) < 2 {
+			t.Errorf("%v %v has no documented success responses", method, path)
+		}
+	}
+}
+
+// Every operation in the spec must be routed by the mux to a pattern for its method and path.
+func TestOpenApiOperationsRouted(t *testing.T) {
+	var h Handler
+	doc := getOpenApiSpec(t, &h)
+	for path, item := range doc.Paths {
+		// Fill in the path parameters, so the request matches the pattern's wildcards.
+		segments := strings.Split(path, "/")
+		for i, seg := range segments {
+			if strings.HasPrefix(seg, "{") {
+				segments[i] = "x"
+			}
+		}
+		target := strings.Join(segments, "/")
+		for method := range item {
+			method = strings.ToUpper(method)
+			_, pattern := h.mux.Handler(httptest.NewRequest(method, target, nil))
+			gotMethod, gotPath, ok := strings.Cut(pattern, " ")
+			if !ok {
+				t.Errorf("%v %v routed to %q", method, path, pattern)
+				continue
+			}
+			gotPath, _ = openApiPath(gotPath)
+			if gotMethod != method || gotPath != path {
+				t.Errorf("%v %v routed to %q", method, path, pattern)
+			}
+		}
+	}
+}
+
+// The spec's Error schema lists every code in errorCodes.
+func TestOpenApiErrorCodes(t *testing.T) {
+	var h Handler
+	doc := getOpenApiSpec(t, &h)
+	enum := doc.Components.Schemas["Error"].Properties["code"].Enum
+	if len(enum) != len(errorCodes) {
+		t.Fatalf("spec has %v codes, expected %v", len(enum), len(errorCodes))
+	}
+	for _, code := range enum {
+		if _, ok := errorCodes[ErrorCode(code)]; !ok {
+			t.Errorf("unknown code %q in the spec", code)
+		}
+	}
+	if !ErrorCodeInfoNotReady.Retryable() || ErrorCodeInternal.Retryable() {
+		t.Error("retryable codes don't match errorCodes")
+	}
+}
@@ -0,0 +1,97 @@
+package confluence
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/missinggo/v2/httptoo"
+)
+
+// The completion of a torrent's pieces, for clients that accept JSON from /pieces.
+type piecesJson struct {
+	Pieces   int `json:"pieces"`
+	Complete int `json:"complete"`
+	// A character per piece, 1 if it's complete, otherwise 0.
+	Bitfield string `json:"bitfield"`
+}
+
+// Responds with the data of the piece at the index query parameter, once it's complete. Headers
+// give the piece's offset in the torrent, its expected hashes, and whether it was complete when
+// requested, so HEAD can be used to check on a piece without waiting for it.
+func pieceHandler(w http.ResponseWriter, r *TorrentRequest) {
+	if !waitForTorrentInfo(w, r) {
+		return
+	}
+	t := r.Torrent
+	s := r.URL.Query().Get("index")
+	index, err := strconv.Atoi(s)
+	if err != nil || index < 0 || index >= t.NumPieces() {
+		r.error(w, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("index %q isn't a piece index less than %v", s, t.NumPieces()))
+		return
+	}
+	piece := t.Piece(index)
+	p := piece.Info()
+	header := w.Header()
+	header.Set("X-Piece-Offset", strconv.FormatInt(p.Offset(), 10))
+	if v1 := p.V1Hash(); v1.Ok {
+		header.Set("X-Piece-Hash", v1.Value.HexString())
+	}
+	if v2 := v2PieceHash(p, t.Info().UpvertedFiles(), t.Metainfo().PieceLayers); v2.Ok {
+		header.Set("X-Piece-Hash-V2", hex.EncodeToString(v2.Value))
+	}
+	header.Set("X-Piece-Complete", strconv.FormatBool(piece.State().Complete))
+	header.Set("Content-Type", octetStreamType)
+	if r.Method == http.MethodHead {
+		header.Set("Content-Length", strconv.FormatInt(p.Length(), 10))
+		return
+	}
+	err = waitPieceComplete(r.Context(), t, piece)
+	if err != nil {
+		if r.Context().Err() != nil {
+			r.error(w, httptoo.StatusClientCancelledRequest, ErrorCodeRequestCanceled, "request canceled")
+			return
+		}
+		r.error(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
+	}
+	http.ServeContent(w, r.Request, "", time.Time{}, io.NewSectionReader(piece.Storage(), 0, p.Length()))
+}
+
+// Responds with the completion of each piece as a bitfield, as in the BitTorrent protocol (BEP 3):
+// the high bit of the first byte is the first piece. Clients that accept JSON get piecesJson.
+func piecesHandler(w http.ResponseWriter, r *TorrentRequest) {
+	if !waitForTorrentInfo(w, r) {
+		return
+	}
+	t := r.Torrent
+	numPieces := t.NumPieces()
+	bitfield := make([]byte, (numPieces+7)/8)
+	var text strings.Builder
+	complete := 0
+	for i := range numPieces {
+		if !t.Piece(i).State().Complete {
+			text.WriteByte('0')
+			continue
+		}
+		bitfield[i/8] |= 0x80 >> (i % 8)
+		text.WriteByte('1')
+		complete++
+	}
+	if acceptsJson(r.Request) {
+		w.Header().Set("Content-Type", jsonContentType)
+		json.NewEncoder(w).Encode(piecesJson{
+			Pieces:   numPieces,
+			Complete: complete,
+			Bitfield: text.String(),
+		})
+		return
+	}
+	w.Header().Set("Content-Type", octetStreamType)
+	w.Write(bitfield)
+}
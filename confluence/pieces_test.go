@@ -0,0 +1,102 @@
+package confluence
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+func TestPieces(t *testing.T) {
+	h := testingHandler(t)
+	a := strings.Repeat("a", 40000)
+	b := strings.Repeat("b", 20000)
+	// Pieces 0 to 2 are in a, and 3 and 4 in b, as files start on piece boundaries.
+	mi := testUploadMetainfo(t, h, map[string]string{
+		"name":         "test",
+		"version":      uploadVersionHybrid,
+		"piece-length": "16384",
+	}, map[string]string{"a": a, "b": b})
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ih := mi.HashInfoBytes().HexString()
+	pieceUrl := func(index int) string {
+		return "/piece?" + url.Values{"ih": {ih}, "index": {strconv.Itoa(index)}}.Encode()
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, pieceUrl(3), nil))
+	data := b[:16384]
+	if w.Code != http.StatusOK || w.Body.String() != data {
+		t.Fatalf("%v %q", w.Code, w.Body.String())
+	}
+	v1 := sha1.Sum([]byte(data))
+	for k, v := range map[string]string{
+		"X-Piece-Offset":   "49152",
+		"X-Piece-Hash":     hex.EncodeToString(v1[:]),
+		"X-Piece-Hash-V2":  hex.EncodeToString(v2PieceDataHash(info.Piece(3), int64(len(b)), []byte(data))),
+		"X-Piece-Complete": "true",
+	} {
+		if w.Header().Get(k) != v {
+			t.Errorf("%v: got %q, expected %q", k, w.Header().Get(k), v)
+		}
+	}
+	// The last piece of a file is short, and HEAD doesn't wait for the data.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodHead, pieceUrl(2), nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != "7232" || w.Body.Len() != 0 {
+		t.Fatalf("head: %v %v %q", w.Code, w.Header(), w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, pieceUrl(5), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("out of range: %v %q", w.Code, w.Body.String())
+	}
+	// Corrupt a piece, so it's incomplete once verified.
+	tor, _, release := h.GetTorrent(mi.HashInfoBytes())
+	defer release()
+	tor.Piece(1).Storage().WriteAt([]byte("x"), 0)
+	testVerify(t, h, url.Values{"ih": {ih}, "begin": {"1"}, "end": {"2"}})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, pieceUrl(1), nil).WithContext(ctx))
+	if w.Header().Get("X-Piece-Complete") != "false" || w.Body.String() == a[16384:32768] {
+		t.Fatalf("incomplete piece: %v %v %q", w.Code, w.Header(), w.Body.String())
+	}
+	// The piece is only prioritized while it's waited for.
+	if prio := tor.Piece(1).State().Priority; prio != torrent.PiecePriorityNone {
+		t.Fatalf("priority after request: %v", prio)
+	}
+	// Priorities set elsewhere outlive requests for the piece.
+	tor.Piece(1).SetPriority(torrent.PiecePriorityNormal)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, pieceUrl(1), nil).WithContext(ctx))
+	if prio := tor.Piece(1).State().Priority; prio != torrent.PiecePriorityNormal {
+		t.Fatalf("priority after request: %v", prio)
+	}
+	tor.Piece(1).SetPriority(torrent.PiecePriorityNone)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/pieces?ih="+ih, nil))
+	if w.Code != http.StatusOK || w.Body.String() != "\xb8" {
+		t.Fatalf("bitfield: %v %q", w.Code, w.Body.String())
+	}
+	r := httptest.NewRequest(http.MethodGet, "/pieces?ih="+ih, nil)
+	r.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Body.String() != `{"pieces":5,"complete":4,"bitfield":"10111"}`+"\n" {
+		t.Fatalf("json: %v %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,628 @@
+package confluence
+
+import (
+	"io"
+	"net/http"
+	"slices"
+
+	"github.com/anacrolix/missinggo/v2/httptoo"
+)
+
+// A route served by Handler. Routes are registered on a ServeMux using method and pattern syntax,
+// requests with other methods receive a 405 with an Allow header. Routes are also described in the
+// OpenAPI spec served at /openapi.json.
+type Route struct {
+	// The methods the route accepts. GET implies HEAD.
+	Methods []string
+	// A ServeMux pattern without the method, such as "/data" or "/data/infohash/{ih}/{path...}".
+	Pattern string
+	// If set, determines the torrent for the request, and TorrentHandler is called with a
+	// reference to it held. Otherwise Handler is used.
+	Torrent        TorrentResolver
+	TorrentHandler func(w http.ResponseWriter, r *TorrentRequest)
+	Handler        http.Handler
+	// Applied around the handler, the first is outermost. They run before the torrent is
+	// determined.
+	Middlewares []Middleware
+	Doc         RouteDoc
+}
+
+type Middleware func(http.Handler) http.Handler
+
+// Describes a route for the OpenAPI spec.
+type RouteDoc struct {
+	Summary     string
+	Description string
+	// Wildcards in the pattern are documented as path parameters automatically if they're not
+	// included here.
+	Params []ParamDoc
+	// The media type of the request body, if one is expected.
+	RequestBody string
+	Responses   []ResponseDoc
+}
+
+type ParamDoc struct {
+	Name string
+	// "query", "path" or "header".
+	In          string
+	Required    bool
+	Description string
+}
+
+type ResponseDoc struct {
+	Status      int
+	Description string
+	ContentType string
+}
+
+const (
+	bencodeContentType     = "application/x-bencode"
+	bittorrentContentType  = "application/x-bittorrent"
+	jsonContentType        = "application/json"
+	textContentType        = "text/plain"
+	octetStreamType        = "application/octet-stream"
+	eventStreamContentType = "text/event-stream"
+)
+
+// Documents the parameters used by TorrentFromQuery.
+var TorrentQueryParams = []ParamDoc{
+	{Name: infohashQueryKey, In: "query", Description: "Infohash of the torrent, as v1 hex or base32, v2 hex, or hex multihash. Required if magnet isn't given."},
+	{Name: magnetQueryKey, In: "query", Description: "Magnet URI for the torrent, instead of ih. A urn:btpk: source (BEP 46) is resolved to the mutable torrent's current infohash."},
+}
+
+func withTorrentQueryParams(params ...ParamDoc) []ParamDoc {
+	return append(append([]ParamDoc(nil), TorrentQueryParams...), params...)
+}
+
+var dhtPeersParams = []ParamDoc{
+	{Name: infohashQueryKey, In: "query", Required: true, Description: "Infohash of the torrent. v2 infohashes are truncated as in the DHT."},
+	{Name: "timeout", In: "query", Description: "Limits the time to traverse the DHT, such as 10s."},
+}
+
+var infohashPathParam = ParamDoc{
+	Name:        InfohashPathWildcard,
+	In:          "path",
+	Required:    true,
+	Description: "Infohash of the torrent, as v1 hex or base32, v2 hex, or hex multihash. Other forms than lowercase hex are redirected to it.",
+}
+
+var nowaitParam = ParamDoc{
+	Name:        "nowait",
+	In:          "query",
+	Description: "Respond immediately with 202 if the torrent info isn't available yet.",
+}
+
+var enrichParam = ParamDoc{
+	Name:        enrichQueryKey,
+	In:          "query",
+	Description: "Add the implicit trackers, the torrent client's address, and a web seed for this service, so the result is immediately usable.",
+}
+
+var dataResponses = []ResponseDoc{
+	{http.StatusOK, "The data.", octetStreamType},
+	{http.StatusPartialContent, "The requested range of the data.", octetStreamType},
+}
+
+var dataPathResponses = append(
+	slices.Clip(dataResponses),
+	ResponseDoc{http.StatusPermanentRedirect, "The infohash isn't in canonical form, redirects to the canonical URL.", ""},
+)
+
+var uploadSessionResponses = []ResponseDoc{
+	{http.StatusOK, "The session, with its id, expiry, and the files with the bytes received of each.", jsonContentType},
+	{http.StatusNotFound, "No session with the id exists, or the file index is out of range.", textContentType},
+}
+
+var get = []string{http.MethodGet}
+
+func gzipMiddleware(h http.Handler) http.Handler {
+	return httptoo.GzipHandler(h)
+}
+
+func (h *Handler) routes() []Route {
+	return []Route{
+		{
+			Methods:        get,
+			Pattern:        "/data",
+			Torrent:        TorrentFromQuery,
+			TorrentHandler: dataQueryHandler,
+			Doc: RouteDoc{
+				Summary:     "Torrent or file data",
+				Description: "Responds with the data of the file at path, or the whole torrent if path isn't given. Supports range requests. Blocks until the data is available.",
+				Params: withTorrentQueryParams(
+					ParamDoc{Name: filePathQueryKey, In: "query", Description: "Display path of a file in the torrent."},
+					ParamDoc{Name: "filename", In: "query", Description: "File name for the Content-Disposition of the response."},
+				),
+				Responses: dataResponses,
+			},
+		},
+		{
+			Methods:        get,
+			Pattern:        "/data/infohash/{ih}",
+			Torrent:        TorrentFromInfohashPath,
+			TorrentHandler: dataPathHandler,
+			Middlewares:    []Middleware{canonicalInfohashPath},
+			Doc: RouteDoc{
+				Summary:   "Torrent data by infohash",
+				Params:    []ParamDoc{infohashPathParam},
+				Responses: dataPathResponses,
+			},
+		},
+		{
+			Methods:        get,
+			Pattern:        "/data/infohash/{ih}/{path...}",
+			Torrent:        TorrentFromInfohashPath,
+			TorrentHandler: dataPathHandler,
+			Middlewares:    []Middleware{canonicalInfohashPath},
+			Doc: RouteDoc{
+				Summary:     "Torrent or file data by path",
+				Description: "As for /data, with the infohash and file display path in the URL path. An empty file path serves the whole torrent.",
+				Params: []ParamDoc{
+					infohashPathParam,
+					{Name: filePathQueryKey, In: "path", Required: true, Description: "Display path of a file in the torrent."},
+				},
+				Responses: dataPathResponses,
+			},
+		},
+		{
+			Methods:        get,
+			Pattern:        "/webseed/{ih}/{path...}",
+			Torrent:        TorrentFromInfohashPath,
+			TorrentHandler: webseedHandler,
+			Doc: RouteDoc{
+				Summary:     "BEP 19 web seed",
+				Description: "Serves torrent data in the layout expected by web seeding clients (BEP 19), for the url-list URL /webseed/<infohash>/. The path is the torrent name, followed by the file path in multi-file torrents. Supports range requests.",
+				Params: []ParamDoc{
+					infohashPathParam,
+					{Name: webseedPathWildcard, In: "path", Required: true, Description: "The torrent name, and file path for multi-file torrents."},
+				},
+				Responses: dataResponses,
+			},
+		},
+		{
+			Methods: get,
+			Pattern: "/status",
+			Handler: http.HandlerFunc(h.statusHandler),
+			Doc: RouteDoc{
+				Summary:   "Torrent client status",
+				Responses: []ResponseDoc{{http.StatusOK, "Textual status of the torrent client, for debugging.", textContentType}},
+			},
+		},
+		{
+			Methods:        get,
+			Pattern:        "/info",
+			Torrent:        TorrentFromQuery,
+			TorrentHandler: infoHandler,
+			Doc: RouteDoc{
+				Summary:     "Torrent info",
+				Description: "Responds with the bencoded info dictionary of the torrent (BEP 3). Blocks until the info is available.",
+				Params:      withTorrentQueryParams(nowaitParam),
+				Responses: []ResponseDoc{
+					{http.StatusOK, "The info bytes.", bencodeContentType},
+					{http.StatusAccepted, "The info isn't available yet and nowait was given.", ""},
+				},
+			},
+		},
+		{
+			Methods:        get,
+			Pattern:        "/events",
+			Torrent:        TorrentFromQuery,
+			TorrentHandler: eventHandler,
+			Doc: RouteDoc{
+				Summary:     "Torrent events websocket",
+				Description: "A websocket emitting Event values encoded as JSON, such as when a piece changes state.",
+				Params:      TorrentQueryParams,
+				Responses:   []ResponseDoc{{http.StatusSwitchingProtocols, "Websocket established.", ""}},
+			},
+		},
+		{
+			Methods:        get,
+			Pattern:        "/fileState",
+			Torrent:        TorrentFromQuery,
+			TorrentHandler: fileStateHandler,
+			Middlewares:    []Middleware{gzipMiddleware},
+			Doc: RouteDoc{
+				Summary: "File piece states",
+				Params: withTorrentQueryParams(
+					ParamDoc{Name: filePathQueryKey, In: "query", Required: true, Description: "Display path of a file in the torrent."},
+				),
+				Responses: []ResponseDoc{{http.StatusOK, "The state of each piece in the file.", jsonContentType}},
+			},
+		},
+		{
+			Methods:        get,
+			Pattern:        "/piece",
+			Torrent:        TorrentFromQuery,
+			TorrentHandler: pieceHandler,
+			Doc: RouteDoc{
+				Summary:     "Piece data",
+				Description: "Responds with the data of a piece, blocking until it's available. Supports range requests. The X-Piece-Offset header has the piece's offset in the torrent, X-Piece-Hash and X-Piece-Hash-V2 have its expected v1 and v2 hashes in hex where known, and X-Piece-Complete whether it was complete when requested. HEAD responds with the headers without waiting.",
+				Params: withTorrentQueryParams(
+					ParamDoc{Name: "index", In: "query", Required: true, Description: "Index of the piece."},
+				),
+				Responses: []ResponseDoc{
+					{http.StatusOK, "The piece data.", octetStreamType},
+					{http.StatusPartialContent, "The requested range of the piece data.", octetStreamType},
+					{http.StatusBadRequest, "The index is missing or out of range.", textContentType},
+				},
+			},
+		},
+		{
+			Methods:        get,
+			Pattern:        "/pieces",
+			Torrent:        TorrentFromQuery,
+			TorrentHandler: piecesHandler,
+			Doc: RouteDoc{
+				Summary:     "Piece completion bitfield",
+				Description: "Responds with a bitfield of the complete pieces as in the BitTorrent protocol, where the high bit of the first byte is the first piece, or JSON with the number of pieces, the number complete, and a string of 1s and 0s if requested with Accept. Blocks until the info is available.",
+				Params:      withTorrentQueryParams(nowaitParam),
+				Responses: []ResponseDoc{
+					{http.StatusOK, "The bitfield.", octetStreamType},
+					{http.StatusAccepted, "The info isn't available yet and nowait was given.", ""},
+				},
+			},
+		},
+		{
+			Methods:        get,
+			Pattern:        "/metainfo",
+			Torrent:        TorrentFromQuery,
+			TorrentHandler: h.contextedMetainfoHandler,
+			Doc: RouteDoc{
+				Summary:     "Torrent metainfo",
+				Description: "Responds with a .torrent file for the torrent, or its fields as JSON if requested with Accept. Blocks until the info is available.",
+				Params:      withTorrentQueryParams(nowaitParam, enrichParam),
+				Responses: []ResponseDoc{
+					{http.StatusOK, "The metainfo.", bittorrentContentType},
+					{http.StatusAccepted, "The info isn't available yet and nowait was given.", ""},
+				},
+			},
+		},
+		{
+			Methods:        get,
+			Pattern:        "/magnet",
+			Torrent:        TorrentFromQuery,
+			TorrentHandler: h.magnetHandler,
+			Doc: RouteDoc{
+				Summary:     "Torrent magnet link",
+				Description: "Responds with a magnet link for the torrent, with its v1 and v2 infohashes, name, trackers and web seeds. Blocks until the info is available.",
+				Params:      withTorrentQueryParams(nowaitParam, enrichParam),
+				Responses: []ResponseDoc{
+					{http.StatusOK, "The magnet URI.", textContentType},
+					{http.StatusAccepted, "The info isn't available yet and nowait was given.", ""},
+				},
+			},
+		},
+		{
+			Methods:        get,
+			Pattern:        "/torrent",
+			Torrent:        TorrentFromQuery,
+			TorrentHandler: h.torrentHandler,
+			Doc: RouteDoc{
+				Summary:     "Torrent state",
+				Description: "Responds with the state of the torrent as JSON, including what's been fetched from each of its web seeds. Doesn't wait for the info.",
+				Params:      TorrentQueryParams,
+				Responses:   []ResponseDoc{{http.StatusOK, "The torrent state.", jsonContentType}},
+			},
+		},
+		{
+			Methods:        []string{http.MethodPost},
+			Pattern:        "/webseeds",
+			Torrent:        TorrentFromQuery,
+			TorrentHandler: h.webseedsPostHandler,
+			Doc: RouteDoc{
+				Summary:     "Add web seeds",
+				Description: "Adds the HTTP web seeds (BEP 19) in the body, one URL per line, to the torrent. Web seeds are also taken from metainfo url-lists and magnet ws parameters. Only web seeds on hosts allowed by the server are added.",
+				Params:      TorrentQueryParams,
+				RequestBody: textContentType,
+				Responses: []ResponseDoc{
+					{http.StatusOK, "The state of each of the torrent's web seeds.", jsonContentType},
+					{http.StatusBadRequest, "A URL isn't HTTP or HTTPS.", jsonContentType},
+					{http.StatusForbidden, "A URL's host isn't allowed.", jsonContentType},
+				},
+			},
+		},
+		{
+			Methods: []string{http.MethodPost},
+			Pattern: "/metainfo",
+			Handler: http.HandlerFunc(h.metainfoPostHandler),
+			Doc: RouteDoc{
+				Summary:     "Add metainfo",
+				Description: "Merges the bencoded metainfo in the body into the torrent it describes, and caches it.",
+				RequestBody: bittorrentContentType,
+				Responses:   []ResponseDoc{{http.StatusOK, "The hex infohash of the torrent.", textContentType}},
+			},
+		},
+		{
+			Methods: get,
+			Pattern: "/bep44",
+			Handler: http.HandlerFunc(h.handleBep44),
+			Doc: RouteDoc{
+				Summary:     "BEP 44 get",
+				Description: "Gets an item from the DHT, with each of the DHT servers. The first item found is returned, unless all is given. Items are cached briefly. The response is the bencoded value, or the whole item with the sequence number, key, signature and salt of mutable items if item is given, or JSON is accepted. In JSON, the value is base64, and the target, key, signature and salt are hex.",
+				Params: []ParamDoc{
+					{Name: "target", In: "query", Required: true, Description: "Hex target of the item."},
+					{Name: "salt", In: "query", Description: "Salt of a mutable item."},
+					{Name: "all", In: "query", Description: "Wait for all DHT servers, and return the mutable item with the highest sequence number."},
+					{Name: "timeout", In: "query", Description: "Limits the time to wait for DHT servers, such as 10s."},
+					{Name: "item", In: "query", Description: "Respond with the bencoded item, rather than just its value."},
+				},
+				Responses: []ResponseDoc{{http.StatusOK, "The bencoded value or item. The item is JSON, with the value base64 encoded, if requested with Accept.", bencodeContentType}},
+			},
+		},
+		{
+			Methods: []string{http.MethodPost},
+			Pattern: "/bep44",
+			Handler: http.HandlerFunc(h.bep44PutHandler),
+			Doc: RouteDoc{
+				Summary:     "BEP 44 put",
+				Description: "Puts the item with the bencoded value in the body, of at most 1000 bytes, to the DHT, with each of the DHT servers. Without k or key, the item is immutable. Mutable items are either signed by the client, given k, sig and seq, or by the server with the key named by key, in which case seq defaults to one more than the latest in the DHT.",
+				Params: []ParamDoc{
+					{Name: "k", In: "query", Description: "Hex ed25519 public key of a mutable item signed by the client."},
+					{Name: "sig", In: "query", Description: "Hex signature of a mutable item signed by the client."},
+					{Name: "key", In: "query", Description: "Name of a server key to sign a mutable item with."},
+					{Name: "seq", In: "query", Description: "Sequence number of a mutable item."},
+					{Name: "cas", In: "query", Description: "Only replace a mutable item with this sequence number."},
+					{Name: "salt", In: "query", Description: "Salt of a mutable item."},
+				},
+				RequestBody: bencodeContentType,
+				Responses: []ResponseDoc{
+					{http.StatusOK, "The target, and the result of the put for each DHT server.", jsonContentType},
+					{http.StatusBadRequest, "The value isn't bencoded, or a parameter is invalid.", textContentType},
+					{http.StatusRequestEntityTooLarge, "The value is longer than the 1000 bytes BEP 44 allows.", textContentType},
+				},
+			},
+		},
+		{
+			Methods: get,
+			Pattern: "/dht",
+			Handler: http.HandlerFunc(h.dhtHandler),
+			Doc: RouteDoc{
+				Summary:     "DHT routing tables",
+				Description: "Responds with statistics for each DHT server, and the number of nodes in each bucket of its routing table.",
+				Params:      []ParamDoc{{Name: "nodes", In: "query", Description: "Include the ID and address of the nodes in each bucket."}},
+				Responses:   []ResponseDoc{{http.StatusOK, "The status of each DHT server.", jsonContentType}},
+			},
+		},
+		{
+			Methods: get,
+			Pattern: "/dht/peers",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h.dhtGetPeers(w, r, false)
+			}),
+			Doc: RouteDoc{
+				Summary:     "DHT get_peers",
+				Description: "Traverses the DHT for peers of the torrent with each DHT server, and responds with the peers found.",
+				Params:      dhtPeersParams,
+				Responses:   []ResponseDoc{{http.StatusOK, "The peers and traversal statistics for each DHT server.", jsonContentType}},
+			},
+		},
+		{
+			Methods: []string{http.MethodPost},
+			Pattern: "/dht/announce",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h.dhtGetPeers(w, r, true)
+			}),
+			Doc: RouteDoc{
+				Summary:     "DHT announce",
+				Description: "As GET /dht/peers, and then announces the torrent client as a peer to the closest nodes found.",
+				Params:      dhtPeersParams,
+				Responses:   []ResponseDoc{{http.StatusOK, "The peers and traversal statistics for each DHT server.", jsonContentType}},
+			},
+		},
+		{
+			Methods: get,
+			Pattern: "/dht/peerStore",
+			Handler: http.HandlerFunc(h.dhtPeerStoreHandler),
+			Doc: RouteDoc{
+				Summary:     "DHT peer stores",
+				Description: "Responds with the peers each DHT server stores from announces by other nodes.",
+				Params:      []ParamDoc{{Name: infohashQueryKey, In: "query", Description: "Only include peers for this infohash."}},
+				Responses:   []ResponseDoc{{http.StatusOK, "The stored peers by infohash for each DHT server.", jsonContentType}},
+			},
+		},
+		{
+			Methods: get,
+			Pattern: "/health",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h.TC.WriteStatus(io.Discard)
+			}),
+			Doc: RouteDoc{
+				Summary:   "Health check",
+				Responses: []ResponseDoc{{http.StatusOK, "The torrent client is responsive.", ""}},
+			},
+		},
+		{
+			Methods: []string{http.MethodPost},
+			Pattern: "/upload",
+			Handler: http.HandlerFunc(h.uploadHandler),
+			Doc: RouteDoc{
+				Summary:     "Create a torrent from uploaded files",
+				Description: "Creates a torrent from the files in the multipart form, and stores their data. The form has a name field, files parts whose filenames are paths within the torrent, and optional fields: strip-top-directory; version, 1 (the default), 2 or hybrid (BEP 52); piece-length, a power of two of at least 16 KiB; private (BEP 27); source; comment; trackers, a URL per line with blank lines between tiers; url-list, web seed URLs (BEP 19); and file-order, form or path. v1 files default to form order, and v2 files are always in path order. The form is read as it arrives, and files are written once to the upload spool directory, as storage needs the infohash, which is only known once every file is hashed. They're hashed as they're received if the version and piece-length fields precede them, and the spool is then only read to store them. Otherwise, or if v1 files are reordered by path, the spool is hashed after the form is received.",
+				Params: []ParamDoc{
+					enrichParam,
+					{Name: "id", In: "query", Description: "Identifies the upload for GET /upload/progress."},
+				},
+				RequestBody: "multipart/form-data",
+				Responses: []ResponseDoc{
+					{http.StatusOK, "The metainfo of the new torrent. If requested with Accept, JSON with the infohash, magnet link, files and data URLs instead.", bittorrentContentType},
+					{http.StatusBadRequest, "The form is malformed, missing the name or files, or has an invalid option.", textContentType},
+					{http.StatusConflict, "Another upload with the id is in progress.", textContentType},
+					{http.StatusInternalServerError, "Storing the torrent failed. No pieces are left complete, and the metainfo isn't saved.", textContentType},
+				},
+			},
+		},
+		{
+			Methods: get,
+			Pattern: "/upload/progress",
+			Handler: http.HandlerFunc(h.uploadProgressHandler),
+			Doc: RouteDoc{
+				Summary: "Progress of an upload",
+				Params:  []ParamDoc{{Name: "id", In: "query", Required: true, Description: "The id given to POST /upload."}},
+				Responses: []ResponseDoc{
+					{http.StatusOK, "The phase (receiving or storing), the files and bytes received, and the pieces stored.", jsonContentType},
+					{http.StatusNotFound, "No upload with the id is in progress.", textContentType},
+				},
+			},
+		},
+		{
+			Methods: []string{http.MethodPost},
+			Pattern: "/upload/check",
+			Handler: http.HandlerFunc(h.uploadCheckHandler),
+			Doc: RouteDoc{
+				Summary:     "Check whether an upload is needed",
+				Description: "Works out the torrent an upload would create from the hashes of its files, and whether it's already cached with all its data stored, in which case uploading it would do nothing. The form has the name and upload options of POST /upload, and a path and length field for each file, in order. v1 and hybrid torrents need a pieces field with the hex of the v1 piece hashes. v2 and hybrid torrents need a pieces-root field for each file with the hex of its BEP 52 pieces root.",
+				RequestBody: "application/x-www-form-urlencoded",
+				Responses: []ResponseDoc{
+					{http.StatusOK, "The infohash the upload would have, and whether the upload is needed.", jsonContentType},
+					{http.StatusBadRequest, "The name, files or hashes are missing or invalid, or an option is invalid.", textContentType},
+				},
+			},
+		},
+		{
+			Methods: []string{http.MethodPost},
+			Pattern: "/upload/sessions",
+			Handler: http.HandlerFunc(h.uploadSessionCreateHandler),
+			Doc: RouteDoc{
+				Summary:     "Start a resumable upload",
+				Description: "Creates an upload session that's kept on disk, to which files are sent in chunks that can be resent after interruptions. The form has the name and upload options of POST /upload, and a path and length field for each file, in order. Sessions expire if no chunks are written to them for a while.",
+				RequestBody: "application/x-www-form-urlencoded",
+				Responses: []ResponseDoc{
+					{http.StatusCreated, "The session, with its id, expiry, and the files with the bytes received of each.", jsonContentType},
+					{http.StatusBadRequest, "The name or files are missing, or an option is invalid.", textContentType},
+					{http.StatusNotFound, "Upload sessions aren't enabled.", textContentType},
+				},
+			},
+		},
+		{
+			Methods: get,
+			Pattern: "/upload/sessions/{id}",
+			Handler: http.HandlerFunc(h.uploadSessionGetHandler),
+			Doc: RouteDoc{
+				Summary:   "Resumable upload state",
+				Responses: uploadSessionResponses,
+			},
+		},
+		{
+			Methods: []string{http.MethodDelete},
+			Pattern: "/upload/sessions/{id}",
+			Handler: http.HandlerFunc(h.uploadSessionDeleteHandler),
+			Doc: RouteDoc{
+				Summary: "Abandon a resumable upload",
+				Responses: []ResponseDoc{
+					{http.StatusNoContent, "The session and its data are removed.", ""},
+					{http.StatusNotFound, "No session with the id exists.", textContentType},
+					{http.StatusConflict, "Chunks are being written, or the session is being finalized.", textContentType},
+				},
+			},
+		},
+		{
+			Methods: []string{http.MethodPut},
+			Pattern: "/upload/sessions/{id}/files/{file}",
+			Handler: http.HandlerFunc(h.uploadSessionChunkHandler),
+			Doc: RouteDoc{
+				Summary:     "Send a chunk of a file in a resumable upload",
+				Description: "Writes the body to the file at the offset. The offset can't be past the bytes already received for the file, so an interrupted upload continues from the received length given in the session. What's received of a failed request is kept.",
+				Params: []ParamDoc{
+					{Name: "file", In: "path", Required: true, Description: "Index of the file in the session."},
+					{Name: "offset", In: "query", Required: true, Description: "Offset of the chunk in the file."},
+				},
+				RequestBody: octetStreamType,
+				Responses: append(slices.Clip(uploadSessionResponses),
+					ResponseDoc{http.StatusBadRequest, "The offset is invalid, or the chunk extends past the end of the file.", textContentType},
+					ResponseDoc{http.StatusConflict, "The offset is past the bytes received, or the session is being finalized.", textContentType},
+				),
+			},
+		},
+		{
+			Methods: []string{http.MethodPost},
+			Pattern: "/upload/sessions/{id}/finalize",
+			Handler: http.HandlerFunc(h.uploadSessionFinalizeHandler),
+			Doc: RouteDoc{
+				Summary:     "Complete a resumable upload",
+				Description: "Creates the torrent from the files once they're all received, and stores their data as for POST /upload. The session is removed if that succeeds.",
+				Params:      []ParamDoc{enrichParam},
+				Responses: []ResponseDoc{
+					{http.StatusOK, "The metainfo of the new torrent. If requested with Accept, JSON with the infohash, magnet link, files and data URLs instead.", bittorrentContentType},
+					{http.StatusNotFound, "No session with the id exists.", textContentType},
+					{http.StatusConflict, "Files haven't been completely received, chunks are being written, or the session is already being finalized.", textContentType},
+					{http.StatusInternalServerError, "Storing the torrent failed. The session is kept so finalizing can be retried.", textContentType},
+				},
+			},
+		},
+		{
+			Methods:        []string{http.MethodPost},
+			Pattern:        "/import",
+			Torrent:        TorrentFromQuery,
+			TorrentHandler: h.importHandler,
+			Doc: RouteDoc{
+				Summary:     "Import torrent data from a directory on the server",
+				Description: "Once the info is available, hashes each incomplete piece from the torrent's files in the directory, laid out as other clients download them: the torrent's name and then the file paths. Pieces that match are written to the torrent's storage and complete. The directory must be within one of the configured import directories.",
+				Params: withTorrentQueryParams(
+					ParamDoc{Name: "dir", In: "query", Required: true, Description: "Absolute path of the directory containing the torrent."},
+				),
+				Responses: []ResponseDoc{
+					{http.StatusOK, "The piece indexes that were imported, already complete, mismatched, missing from the directory, or unverifiable as v2 piece layers aren't known yet.", jsonContentType},
+					{http.StatusBadRequest, "The dir is missing, relative or not a directory.", textContentType},
+					{http.StatusForbidden, "The dir isn't within an import directory, before or after resolving symlinks.", textContentType},
+					{http.StatusNotFound, "The dir doesn't exist.", textContentType},
+				},
+			},
+		},
+		{
+			Methods:        []string{http.MethodPost},
+			Pattern:        "/verify",
+			Torrent:        TorrentFromQuery,
+			TorrentHandler: verifyHandler,
+			Doc: RouteDoc{
+				Summary:     "Verify torrent data in storage",
+				Description: "Once the info is available, hashes the complete pieces of the torrent, or of a file or piece range, from storage. Pieces that fail are marked incomplete, so they're fetched again when next read. With Accept: text/event-stream, a progress event is sent as each piece is verified, and then a summary event.",
+				Params: withTorrentQueryParams(
+					ParamDoc{Name: filePathQueryKey, In: "query", Description: "Display path of a file to verify the pieces of."},
+					ParamDoc{Name: "begin", In: "query", Description: "Index of the first piece to verify."},
+					ParamDoc{Name: "end", In: "query", Description: "Index after the last piece to verify."},
+				),
+				Responses: []ResponseDoc{
+					{http.StatusOK, "The number of pieces in the range, verified and incomplete, and the indexes of the bad pieces. Server-sent events if requested.", jsonContentType},
+					{http.StatusBadRequest, "The piece range is invalid.", textContentType},
+					{http.StatusNotFound, "The file isn't in the torrent.", textContentType},
+				},
+			},
+		},
+		{
+			Methods: get,
+			Pattern: "/openapi.json",
+			Handler: http.HandlerFunc(h.openApiHandler),
+			Doc: RouteDoc{
+				Summary:   "OpenAPI specification",
+				Responses: []ResponseDoc{{http.StatusOK, "This document.", jsonContentType}},
+			},
+		},
+	}
+}
+
+// The route for POST /admin/seedDir, which isn't served unless it's added to ExtraRoutes. It lets
+// clients hash and seed any directory within SeedDirs, and has no authentication of its own, so
+// mount it where only trusted clients can reach it.
+func (h *Handler) SeedDirRoute() Route {
+	return Route{
+		Methods: []string{http.MethodPost},
+		Pattern: "/admin/seedDir",
+		Handler: http.HandlerFunc(h.seedDirHandler),
+		Doc: RouteDoc{
+			Summary:     "Create a torrent from a directory on the server and seed it in place",
+			Description: "Hashes the regular files in the directory in parallel, and seeds the torrent from them without copying. The directory must be within one of the configured seed directories, and is the torrent's name. The form takes the upload options of POST /upload other than strip-top-directory and file-order, and files are always in path order. The torrent isn't kept across restarts.",
+			Params: []ParamDoc{
+				enrichParam,
+				{Name: "path", In: "query", Required: true, Description: "Absolute path of the directory. May also be a form field."},
+			},
+			RequestBody: "application/x-www-form-urlencoded",
+			Responses: []ResponseDoc{
+				{http.StatusOK, "The metainfo of the torrent. If requested with Accept, JSON with the infohash, magnet link, files and data URLs instead.", bittorrentContentType},
+				{http.StatusBadRequest, "The path is missing, relative or not a directory, the directory has no files, or an option is invalid.", textContentType},
+				{http.StatusForbidden, "The path isn't within a seed directory, before or after resolving symlinks.", textContentType},
+				{http.StatusNotFound, "The path doesn't exist.", textContentType},
+				{http.StatusConflict, "The torrent is already seeded from another directory, or in the client with other storage.", textContentType},
+			},
+		},
+	}
+}
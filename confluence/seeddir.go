@@ -0,0 +1,384 @@
+package confluence
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/anacrolix/missinggo/v2/httptoo"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// A file on the server to create a torrent from.
+type localFile struct {
+	osPath string
+	length int64
+}
+
+// Creates a torrent from a directory on the server within one of Handler.SeedDirs, and seeds it
+// from the original files. The path field gives the directory, and the other fields are the upload
+// options, see parseUploadOptions. Responds as for uploads.
+func (h *Handler) seedDirHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("parsing form: %v", err))
+		return
+	}
+	opts, err := parseUploadOptions(r.Form)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	dir, status, pathErr := allowedDirPath(r.Form.Get("path"), h.SeedDirs)
+	if pathErr != nil {
+		writeError(w, r, status, pathErr)
+		return
+	}
+	info := metainfo.Info{Name: filepath.Base(dir)}
+	files, err := walkSeedDir(dir)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, fmt.Sprintf("listing directory: %v", err))
+		return
+	}
+	if len(files) == 0 {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "no files in directory")
+		return
+	}
+	for _, f := range files {
+		rel, _ := filepath.Rel(dir, f.osPath)
+		path := strings.Split(filepath.ToSlash(rel), "/")
+		info.Files = append(info.Files, metainfo.FileInfo{
+			Length:   f.length,
+			Path:     path,
+			PathUtf8: path,
+		})
+	}
+	// The walk is already in path order, so the file order option makes no difference.
+	err = sortFileTreeOrder(info.Files, files)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
+	}
+	info.PieceLength = opts.pieceLength
+	if info.PieceLength == 0 {
+		info.PieceLength = metainfo.ChoosePieceLength(info.TotalLength())
+	}
+	pieceLayers, err := hashLocalFiles(r.Context(), &info, files, opts.version)
+	if err != nil {
+		if r.Context().Err() != nil {
+			httpError(w, r, httptoo.StatusClientCancelledRequest, ErrorCodeRequestCanceled, "request canceled")
+			return
+		}
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, fmt.Sprintf("hashing files: %v", err))
+		return
+	}
+	mi, ih, err := newUploadMetainfo(&info, &opts, pieceLayers)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
+	}
+	status, seedErr := h.seedInPlace(dir, &info, &mi, ih)
+	if seedErr != nil {
+		writeError(w, r, status, seedErr)
+		return
+	}
+	h.writeUploadResult(w, r, &info, &mi)
+}
+
+// Returns the directory for a request that reads from the server's filesystem. It must be absolute,
+// and within one of the allowed directories before and after resolving symlinks.
+func allowedDirPath(path string, allowed []string) (dir string, status int, err *Error) {
+	if path == "" {
+		return "", http.StatusBadRequest, newError(ErrorCodeBadRequest, "missing path")
+	}
+	if !filepath.IsAbs(path) {
+		return "", http.StatusBadRequest, newError(ErrorCodeBadRequest, fmt.Sprintf("path %q isn't absolute", path))
+	}
+	forbidden := newError(ErrorCodeForbidden, fmt.Sprintf("path %q isn't within an allowed directory", path))
+	if !pathWithinDirs(filepath.Clean(path), allowed) {
+		return "", http.StatusForbidden, forbidden
+	}
+	dir, evalErr := filepath.EvalSymlinks(path)
+	if errors.Is(evalErr, fs.ErrNotExist) {
+		return "", http.StatusNotFound, newError(ErrorCodeNotFound, fmt.Sprintf("path %q doesn't exist", path))
+	}
+	if evalErr != nil {
+		return "", http.StatusInternalServerError, newError(ErrorCodeInternal, evalErr.Error())
+	}
+	if !pathWithinDirs(dir, allowed) {
+		return "", http.StatusForbidden, forbidden
+	}
+	fi, statErr := os.Stat(dir)
+	if statErr != nil {
+		return "", http.StatusInternalServerError, newError(ErrorCodeInternal, statErr.Error())
+	}
+	if !fi.IsDir() {
+		return "", http.StatusBadRequest, newError(ErrorCodeBadRequest, fmt.Sprintf("path %q isn't a directory", path))
+	}
+	return dir, 0, nil
+}
+
+// Whether the clean absolute path is within one of the directories, as given or with symlinks
+// resolved.
+func pathWithinDirs(path string, dirs []string) bool {
+	for _, allowed := range dirs {
+		candidates := []string{filepath.Clean(allowed)}
+		if resolved, err := filepath.EvalSymlinks(allowed); err == nil {
+			candidates = append(candidates, resolved)
+		}
+		for _, c := range candidates {
+			rel, err := filepath.Rel(c, path)
+			if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the regular files in the directory in path order. Symlinks aren't followed, as they could
+// lead outside it.
+func walkSeedDir(dir string) (files []localFile, err error) {
+	err = filepath.WalkDir(dir, func(osPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, localFile{osPath: osPath, length: fi.Size()})
+		return nil
+	})
+	return
+}
+
+// Sets the hashes in info for the files. Files are hashed in parallel for v2 and hybrid torrents,
+// and pieces for v1 torrents, where they span files.
+func hashLocalFiles(ctx context.Context, info *metainfo.Info, files []localFile, version string) (
+	pieceLayers map[string]string, err error,
+) {
+	if version == "" || version == uploadVersionV1 {
+		var all concatFiles
+		all.offsets = []int64{0}
+		defer all.Close()
+		for _, f := range files {
+			var file *os.File
+			file, err = os.Open(f.osPath)
+			if err != nil {
+				return
+			}
+			all.files = append(all.files, file)
+			all.offsets = append(all.offsets, all.offsets[len(all.offsets)-1]+f.length)
+		}
+		total := info.TotalLength()
+		numPieces := int((total + info.PieceLength - 1) / info.PieceLength)
+		info.Pieces = make([]byte, sha1.Size*numPieces)
+		err = parallelFor(ctx, numPieces, func(i int) error {
+			off := int64(i) * info.PieceLength
+			hash := sha1.New()
+			_, err := io.Copy(hash, io.NewSectionReader(&all, off, min(info.PieceLength, total-off)))
+			copy(info.Pieces[i*sha1.Size:], hash.Sum(nil))
+			return err
+		})
+		return
+	}
+	hashers := make([]*v2FileHasher, len(files))
+	err = parallelFor(ctx, len(files), func(i int) error {
+		f, err := os.Open(files[i].osPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		hashers[i] = newV2FileHasher(info.PieceLength, version == uploadVersionHybrid)
+		n, err := io.Copy(hashers[i], f)
+		if err == nil && n != files[i].length {
+			err = fmt.Errorf("%q changed size while hashing", files[i].osPath)
+		}
+		return err
+	})
+	if err != nil {
+		return
+	}
+	pieceLayers = setV2Info(info, info.Files, hashers)
+	return
+}
+
+// Reads files consecutively, as the data of a v1 torrent.
+type concatFiles struct {
+	files []*os.File
+	// The offset of each file, followed by the total length.
+	offsets []int64
+}
+
+func (me *concatFiles) ReadAt(b []byte, off int64) (n int, err error) {
+	// The last file starting at or before the offset.
+	i, _ := slices.BinarySearch(me.offsets, off+1)
+	i--
+	for n < len(b) && i < len(me.files) {
+		fileOff := off + int64(n) - me.offsets[i]
+		remaining := me.offsets[i+1] - me.offsets[i] - fileOff
+		if remaining <= 0 {
+			i++
+			continue
+		}
+		var m int
+		m, err = me.files[i].ReadAt(b[n:n+int(min(int64(len(b)-n), remaining))], fileOff)
+		n += m
+		if err != nil {
+			// Including io.EOF if the file got shorter.
+			return n, fmt.Errorf("reading %q: %w", me.files[i].Name(), err)
+		}
+	}
+	if n < len(b) {
+		err = io.EOF
+	}
+	return
+}
+
+func (me *concatFiles) Close() {
+	for _, f := range me.files {
+		f.Close()
+	}
+}
+
+// Opens the files to read consecutively as torrent data. If alignment is non-zero, files after the
+// first are padded with zeroes to start at a multiple of it, as in v2 torrents.
+func openLocalFiles(files []localFile, alignment int64) (data io.Reader, closeFiles func(), err error) {
+	readers := make([]io.Reader, 0, 2*len(files))
+	var opened []*os.File
+	closeFiles = func() {
+		for _, f := range opened {
+			f.Close()
+		}
+	}
+	var offset int64
+	for _, f := range files {
+		if alignment != 0 && offset%alignment != 0 {
+			pad := alignment - offset%alignment
+			readers = append(readers, io.LimitReader(zeroReader{}, pad))
+			offset += pad
+		}
+		var file *os.File
+		file, err = os.Open(f.osPath)
+		if err != nil {
+			closeFiles()
+			return
+		}
+		opened = append(opened, file)
+		readers = append(readers, io.LimitReader(file, f.length))
+		offset += f.length
+	}
+	data = io.MultiReader(readers...)
+	return
+}
+
+// Calls f for each index below n, up to GOMAXPROCS at a time. Returns the first error, after which
+// no more calls are started, or the context's error.
+func parallelFor(ctx context.Context, n int, f func(i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		next     atomic.Int64
+		errOnce  sync.Once
+		firstErr error
+	)
+	for range min(n, runtime.GOMAXPROCS(0)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				i := int(next.Add(1) - 1)
+				if i >= n {
+					return
+				}
+				if err := f(i); err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// Adds the torrent to the client with file storage over the directory, with every piece complete,
+// so it's seeded from the original files. The torrent is never released, so it isn't dropped. A
+// directory can be seeded again with the same result.
+func (h *Handler) seedInPlace(dir string, info *metainfo.Info, mi *metainfo.MetaInfo, ih metainfo.Hash) (status int, err *Error) {
+	h.seededMu.Lock()
+	defer h.seededMu.Unlock()
+	if seeded, ok := h.seeded[ih]; ok {
+		if seeded == dir {
+			return 0, nil
+		}
+		return http.StatusConflict, newError(ErrorCodeConflict, fmt.Sprintf("torrent is already seeded from %q", seeded))
+	}
+	// File storage has no special case for padding files, so it would read them from the directory,
+	// and create them there when flushing. Hybrid torrents are stored by their v2 file tree, which
+	// has no padding, and v1 torrents are created without it, so this is only a safeguard.
+	for _, f := range info.UpvertedFiles() {
+		if strings.Contains(f.Attr, "p") {
+			return http.StatusInternalServerError, newError(ErrorCodeInternal, "can't seed padding files in place")
+		}
+	}
+	// The files were just hashed, so there's no need for the client to check them.
+	completion := storage.NewMapPieceCompletion()
+	for i := range info.NumPieces() {
+		completion.Set(metainfo.PieceKey{InfoHash: ih, Index: i}, true)
+	}
+	spec, specErr := torrent.TorrentSpecFromMetaInfoErr(mi)
+	if specErr != nil {
+		return http.StatusInternalServerError, newError(ErrorCodeInternal, specErr.Error())
+	}
+	t, new, release := h.getTorrent(torrent.AddTorrentOpts{
+		InfoHash:   spec.InfoHash,
+		InfoHashV2: spec.InfoHashV2,
+		// The torrent name is the directory's, so its files are where the storage expects.
+		Storage: storage.NewFileOpts(storage.NewFileClientOpts{
+			ClientBaseDir:   filepath.Dir(dir),
+			PieceCompletion: completion,
+		}),
+		InfoBytes: mi.InfoBytes,
+	})
+	if !new {
+		release()
+		return http.StatusConflict, newError(ErrorCodeConflict, "torrent is already in the client with other storage")
+	}
+	if h.OnNewTorrent != nil {
+		h.OnNewTorrent(t, mi)
+	} else if mergeErr := h.mergeSpec(t, spec); mergeErr != nil {
+		t.Drop()
+		release()
+		return http.StatusInternalServerError, newError(ErrorCodeInternal, fmt.Sprintf("merging spec: %v", mergeErr))
+	}
+	if h.seeded == nil {
+		h.seeded = make(map[metainfo.Hash]string)
+	}
+	h.seeded[ih] = dir
+	return 0, nil
+}
@@ -0,0 +1,228 @@
+package confluence
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func testSeedDirRequest(h http.Handler, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/admin/seedDir", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestSeedDir(t *testing.T) {
+	// Pieces span the files for v1.
+	files := map[string]string{
+		"a":     strings.Repeat("a", 20000),
+		"dir/b": strings.Repeat("b", 30000),
+		"dir/c": "c",
+	}
+	root := t.TempDir()
+	dir := filepath.Join(root, "content")
+	for p, data := range files {
+		osPath := filepath.Join(dir, filepath.FromSlash(p))
+		os.MkdirAll(filepath.Dir(osPath), 0o755)
+		err := os.WriteFile(osPath, []byte(data), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, version := range []string{uploadVersionV1, uploadVersionV2, uploadVersionHybrid} {
+		h := testingHandler(t)
+		h.SeedDirs = []string{root}
+		h.ExtraRoutes = []Route{h.SeedDirRoute()}
+		form := url.Values{"path": {dir}, "version": {version}, "piece-length": {"16384"}}
+		w := testSeedDirRequest(h, form)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: %v %q", version, w.Code, w.Body.String())
+		}
+		mi, err := metainfo.Load(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The same files uploaded give the same info.
+		expected := testUploadMetainfo(t, testingHandler(t), map[string]string{
+			"name":         "content",
+			"version":      version,
+			"piece-length": "16384",
+			"file-order":   "path",
+		}, files)
+		if string(mi.InfoBytes) != string(expected.InfoBytes) {
+			t.Fatalf("%v: info differs from upload", version)
+		}
+		ih, _ := metainfoCanonicalInfohash(mi)
+		for p, data := range files {
+			// The pieces are complete, so this would block if the data weren't read from the files.
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/data/infohash/"+ih+"/"+p, nil).WithContext(ctx))
+			cancel()
+			if w.Body.String() != data {
+				t.Errorf("%v: %v: %v %q", version, p, w.Code, w.Body.String())
+			}
+		}
+		testSeedDirPieces(t, h, mi, root)
+		// Seeding the directory again is harmless.
+		w = testSeedDirRequest(h, form)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: seeding again: %v %q", version, w.Code, w.Body.String())
+		}
+	}
+}
+
+// Reads every piece and verifies them. The v1 hashes of hybrid torrents cover padding between the
+// files, which mustn't be read from or written to the seeded directory.
+func testSeedDirPieces(t *testing.T, h http.Handler, mi *metainfo.MetaInfo, root string) {
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for _, f := range info.UpvertedFiles() {
+		// Files of v2 and hybrid torrents start on piece boundaries.
+		data = append(data, make([]byte, f.TorrentOffset-int64(len(data)))...)
+		b, err := os.ReadFile(filepath.Join(append([]string{root, info.Name}, f.Path...)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, b...)
+	}
+	ih, _ := metainfoCanonicalInfohash(mi)
+	for i := range info.NumPieces() {
+		p := info.Piece(i)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/piece?"+url.Values{
+			"ih":    {ih},
+			"index": {strconv.Itoa(i)},
+		}.Encode(), nil).WithContext(ctx))
+		cancel()
+		if w.Code != http.StatusOK || w.Body.String() != string(data[p.Offset():p.Offset()+p.Length()]) {
+			t.Errorf("piece %v: %v %q", i, w.Code, w.Body.String())
+		}
+	}
+	res := testVerify(t, h, url.Values{"ih": {ih}})
+	if res.Verified != info.NumPieces() || len(res.Bad) != 0 {
+		t.Errorf("verify: %+v", res)
+	}
+	_, err = os.Stat(filepath.Join(root, info.Name, ".pad"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("padding was written to the seeded directory: %v", err)
+	}
+}
+
+func TestSeedDirPaths(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "file"), []byte("secret"), 0o644)
+	os.Mkdir(filepath.Join(root, "empty"), 0o755)
+	os.WriteFile(filepath.Join(root, "file"), []byte("file"), 0o644)
+	err := os.Symlink(outside, filepath.Join(root, "escape"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := testingHandler(t)
+	h.SeedDirs = []string{root}
+	h.ExtraRoutes = []Route{h.SeedDirRoute()}
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"", http.StatusBadRequest},
+		{"content", http.StatusBadRequest},
+		{outside, http.StatusForbidden},
+		{filepath.Join(root, ".."), http.StatusForbidden},
+		{filepath.Join(root, "escape"), http.StatusForbidden},
+		{filepath.Join(root, "missing"), http.StatusNotFound},
+		{filepath.Join(root, "file"), http.StatusBadRequest},
+		{filepath.Join(root, "empty"), http.StatusBadRequest},
+	} {
+		w := testSeedDirRequest(h, url.Values{"path": {tc.path}})
+		if w.Code != tc.status {
+			t.Errorf("%q: expected %v, got %v %q", tc.path, tc.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+// A torrent can only be seeded from one directory.
+func TestSeedDirConflict(t *testing.T) {
+	h := testingHandler(t)
+	for _, root := range []string{t.TempDir(), t.TempDir()} {
+		dir := filepath.Join(root, "content")
+		os.Mkdir(dir, 0o755)
+		os.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0o644)
+		h.SeedDirs = append(h.SeedDirs, root)
+	}
+	h.ExtraRoutes = []Route{h.SeedDirRoute()}
+	w := testSeedDirRequest(h, url.Values{"path": {filepath.Join(h.SeedDirs[0], "content")}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("%v %q", w.Code, w.Body.String())
+	}
+	r := httptest.NewRequest(http.MethodPost, "/admin/seedDir", strings.NewReader(url.Values{
+		"path": {filepath.Join(h.SeedDirs[1], "content")},
+	}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var e Error
+	json.Unmarshal(w.Body.Bytes(), &e)
+	if w.Code != http.StatusConflict || e.Code != ErrorCodeConflict {
+		t.Fatalf("%v %q", w.Code, w.Body.String())
+	}
+}
+
+// A torrent whose spec can't be merged isn't left in the client or recorded as seeded.
+func TestSeedDirMergeSpecFailure(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "content")
+	os.Mkdir(dir, 0o755)
+	os.WriteFile(filepath.Join(dir, "a"), []byte(strings.Repeat("a", 40000)), 0o644)
+	h := testingHandler(t)
+	h.SeedDirs = []string{root}
+	h.ExtraRoutes = []Route{h.SeedDirRoute()}
+	h.ModifyTorrentSpec = func(spec *torrent.TorrentSpec) {
+		for k := range spec.PieceLayers {
+			spec.PieceLayers[k] = "bad"
+		}
+	}
+	w := testSeedDirRequest(h, url.Values{"path": {dir}, "version": {uploadVersionHybrid}, "piece-length": {"16384"}})
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("%v %q", w.Code, w.Body.String())
+	}
+	if n := len(h.TC.Torrents()); n != 0 {
+		t.Fatalf("%v torrents in the client", n)
+	}
+	h.ModifyTorrentSpec = nil
+	w = testSeedDirRequest(h, url.Values{"path": {dir}, "version": {uploadVersionHybrid}, "piece-length": {"16384"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("%v %q", w.Code, w.Body.String())
+	}
+}
+
+// The route is only served if it's added to ExtraRoutes.
+func TestSeedDirRouteNotServedByDefault(t *testing.T) {
+	h := testingHandler(t)
+	h.SeedDirs = []string{t.TempDir()}
+	w := testSeedDirRequest(h, url.Values{"path": {h.SeedDirs[0]}})
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("%v %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,19 @@
+package confluence
+
+import (
+	"testing"
+
+	"github.com/anacrolix/confluence/confluence/internal/testutil"
+)
+
+// Returns a Handler with its own torrent Client that doesn't talk to the outside world, and keeps
+// all its data in temporary directories that are removed when the test completes.
+func testingHandler(t testing.TB) *Handler {
+	cl, metainfoStorage, storageClient := testutil.HandlerParts(t)
+	return &Handler{
+		TC:                       cl,
+		MetainfoStorageInterface: metainfoStorage,
+		Storage:                  storageClient,
+		UploadSpoolDir:           t.TempDir(),
+	}
+}
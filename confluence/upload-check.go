@@ -0,0 +1,146 @@
+package confluence
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// The response to an upload check.
+type uploadCheckJson struct {
+	// The infohash the upload would have, as in uploadResultJson.
+	Infohash string `json:"infohash"`
+	// False if the torrent is cached with all its pieces stored, so uploading it would do nothing.
+	UploadNeeded bool `json:"uploadNeeded"`
+}
+
+// Responds with whether files need uploading, before they're sent. The form has the name and upload
+// options, path and length fields for each file in order, and the hashes the torrent is made from:
+// for v1 and hybrid torrents, pieces is the hex of the v1 piece hashes, and for v2 and hybrid
+// torrents, there's a pieces-root field for each file with the hex of its BEP 52 pieces root, which
+// doesn't depend on the piece length. Without piece-length, it's chosen from the total length of
+// the files as for /upload.
+func (h *Handler) uploadCheckHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("parsing form: %v", err))
+		return
+	}
+	name := r.PostForm.Get("name")
+	if name == "" {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "missing name field")
+		return
+	}
+	opts, err := parseUploadOptions(r.PostForm)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	files, err := parseUploadFileFields(r.PostForm, opts.stripTopDirectory)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	info, err := uploadCheckInfo(name, files, &opts, r.PostForm)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	mi, ih, err := newUploadMetainfo(&info, &opts, nil)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
+	}
+	var ret uploadCheckJson
+	ret.Infohash, _ = metainfoCanonicalInfohash(&mi)
+	ret.UploadNeeded, err = h.uploadNeeded(r.Context(), ih)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	json.NewEncoder(w).Encode(ret)
+}
+
+// Returns the info an upload of the files would have, from the hashes in the form. See
+// uploadCheckHandler.
+func uploadCheckInfo(name string, files []metainfo.FileInfo, opts *uploadOptions, form url.Values) (
+	info metainfo.Info, err error,
+) {
+	info.Name = name
+	info.Files = files
+	v1 := opts.version == "" || opts.version == uploadVersionV1
+	roots := form["pieces-root"]
+	if v1 {
+		// Only sorted along with the files.
+		roots = make([]string, len(files))
+	} else if len(roots) != len(files) {
+		err = errors.New("expected a pieces-root for each file")
+		return
+	}
+	if opts.sortFiles {
+		err = sortFileTreeOrder(info.Files, roots)
+		if err != nil {
+			return
+		}
+	}
+	info.PieceLength = opts.pieceLength
+	if info.PieceLength == 0 {
+		info.PieceLength = metainfo.ChoosePieceLength(info.TotalLength())
+	}
+	if !v1 {
+		treeFiles := make([]metainfo.FileTreeFile, 0, len(files))
+		for i, fi := range info.Files {
+			treeFile := metainfo.FileTreeFile{Length: fi.Length}
+			if fi.Length != 0 {
+				root, decodeErr := hex.DecodeString(roots[i])
+				if decodeErr != nil || len(root) != 32 {
+					err = fmt.Errorf("invalid pieces-root %q", roots[i])
+					return
+				}
+				treeFile.PiecesRoot = string(root)
+			}
+			treeFiles = append(treeFiles, treeFile)
+		}
+		setV2FileTree(&info, info.Files, treeFiles, opts.version == uploadVersionHybrid)
+	}
+	if opts.version == uploadVersionV2 {
+		return
+	}
+	// Includes the padding between files in hybrid torrents.
+	var v1Length int64
+	for _, fi := range info.Files {
+		v1Length += fi.Length
+	}
+	numPieces := (v1Length + info.PieceLength - 1) / info.PieceLength
+	info.Pieces, err = hex.DecodeString(form.Get("pieces"))
+	if err != nil || int64(len(info.Pieces)) != numPieces*20 {
+		err = fmt.Errorf("pieces should be the hex of %v v1 piece hashes", numPieces)
+	}
+	return
+}
+
+// Returns whether an upload of the torrent with the infohash is needed, as it isn't cached with all
+// its pieces stored.
+func (h *Handler) uploadNeeded(ctx context.Context, ih metainfo.Hash) (bool, error) {
+	mi, err := h.cachedMetaInfo(ih)
+	if err != nil || mi == nil {
+		return true, err
+	}
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return true, fmt.Errorf("unmarshalling cached info: %w", err)
+	}
+	torrentStorage, err := h.Storage.OpenTorrent(ctx, &info, ih)
+	if err != nil {
+		return true, fmt.Errorf("opening storage for torrent: %w", err)
+	}
+	defer torrentStorage.Close()
+	return !uploadPiecesComplete(torrentStorage, &info, mi.PieceLayers), nil
+}
@@ -0,0 +1,113 @@
+package confluence
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func testUploadCheck(t *testing.T, h http.Handler, form url.Values) uploadCheckJson {
+	r := httptest.NewRequest(http.MethodPost, "/upload/check", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return testJsonRequest[uploadCheckJson](t, h, r, http.StatusOK)
+}
+
+func TestUploadCheck(t *testing.T) {
+	const pieceLength = 1 << 15
+	paths := []string{"a", "dir/b"}
+	files := map[string]string{
+		"a":     strings.Repeat("a", 20000),
+		"dir/b": strings.Repeat("b", 70000),
+	}
+	for _, version := range []string{uploadVersionV1, uploadVersionV2, uploadVersionHybrid} {
+		form := url.Values{
+			"name":         {"test"},
+			"version":      {version},
+			"piece-length": {strconv.Itoa(pieceLength)},
+		}
+		// The hashes a client would compute.
+		v1 := newV1PieceHasher(pieceLength)
+		var hybridPieces []byte
+		for i, p := range paths {
+			form.Add("path", p)
+			form.Add("length", strconv.Itoa(len(files[p])))
+			v1.Write([]byte(files[p]))
+			// Pieces roots don't depend on the piece length.
+			root := newV2FileHasher(1<<14, false)
+			root.Write([]byte(files[p]))
+			form.Add("pieces-root", hex.EncodeToString([]byte(root.fileTreeFile(map[string]string{}).PiecesRoot)))
+			hybrid := newV1PieceHasher(pieceLength)
+			hybrid.Write([]byte(files[p]))
+			hybridPieces = append(hybridPieces, hybrid.finish(i != len(paths)-1)...)
+		}
+		form.Set("pieces", hex.EncodeToString(v1.finish(false)))
+		if version == uploadVersionHybrid {
+			form.Set("pieces", hex.EncodeToString(hybridPieces))
+		}
+		h := testingHandler(t)
+		before := testUploadCheck(t, h, form)
+		if !before.UploadNeeded {
+			t.Fatalf("%v: upload not needed before uploading", version)
+		}
+		mi := testUploadMetainfo(t, h, map[string]string{
+			"name":         "test",
+			"version":      version,
+			"piece-length": strconv.Itoa(pieceLength),
+		}, files)
+		ih, _ := metainfoCanonicalInfohash(mi)
+		if before.Infohash != ih {
+			t.Fatalf("%v: checked infohash %v, uploaded %v", version, before.Infohash, ih)
+		}
+		after := testUploadCheck(t, h, form)
+		if after.UploadNeeded || after.Infohash != ih {
+			t.Fatalf("%v: after uploading: %+v", version, after)
+		}
+		// Uploading the same files again doesn't read the data.
+		info, err := mi.UnmarshalInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		var opts uploadOptions
+		if !h.completeUpload(
+			w, httptest.NewRequest(http.MethodPost, "/upload", nil),
+			&info, &opts, mi.PieceLayers, iotest.ErrReader(errors.New("data was read")), nil,
+		) {
+			t.Fatalf("%v: uploading again: %v %q", version, w.Code, w.Body.String())
+		}
+		again, err := metainfo.Load(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(again.InfoBytes) != string(mi.InfoBytes) {
+			t.Fatalf("%v: info differs uploading again", version)
+		}
+	}
+}
+
+func TestUploadCheckInvalid(t *testing.T) {
+	h := testingHandler(t)
+	for _, form := range []url.Values{
+		{"name": {"test"}, "path": {"a"}, "length": {"1"}},
+		{"name": {"test"}, "path": {"a"}, "length": {"1"}, "pieces": {"00"}},
+		{"name": {"test"}, "path": {"a"}, "length": {"1"}, "version": {uploadVersionV2}},
+		{"name": {"test"}, "path": {"a"}, "length": {"1"}, "version": {uploadVersionV2}, "pieces-root": {"00"}},
+		{"name": {"test"}, "path": {"../a"}, "length": {"1"}, "pieces": {strings.Repeat("00", 20)}},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/upload/check", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: %v %q", form, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package confluence
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/missinggo/v2/httptoo"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+const (
+	defaultUploadSessionExpiry = 24 * time.Hour
+	uploadSessionFileName      = "session.json"
+)
+
+// A resumable upload, persisted in its directory under Handler.UploadSessionDir. The data received
+// for each file is in a file named by its index, and its size is how much has been received, as
+// chunks must continue from data already received. The session's modification time is when a
+// chunk was last written.
+type uploadSession struct {
+	Name string `json:"name"`
+	// The upload options, see parseUploadOptions.
+	Options url.Values          `json:"options"`
+	Files   []uploadSessionFile `json:"files"`
+}
+
+type uploadSessionFile struct {
+	Path   []string `json:"path"`
+	Length int64    `json:"length"`
+}
+
+// The state of an upload session in responses.
+type uploadSessionJson struct {
+	Id      string                  `json:"id"`
+	Expires time.Time               `json:"expires"`
+	Files   []uploadSessionFileJson `json:"files"`
+}
+
+type uploadSessionFileJson struct {
+	Path     string `json:"path"`
+	Length   int64  `json:"length"`
+	Received int64  `json:"received"`
+}
+
+func (h *Handler) uploadSessionExpiry() time.Duration {
+	if h.UploadSessionExpiry == 0 {
+		return defaultUploadSessionExpiry
+	}
+	return h.UploadSessionExpiry
+}
+
+func (h *Handler) uploadSessionPath(id string, elem ...string) string {
+	return filepath.Join(append([]string{h.UploadSessionDir, id}, elem...)...)
+}
+
+func (h *Handler) uploadSessionDataPath(id string, file int) string {
+	return h.uploadSessionPath(id, strconv.Itoa(file))
+}
+
+// Creates a resumable upload session from a form with the name, the upload options, and path and
+// length fields for each file in order. Files are then sent in chunks with PUT, and the upload is
+// completed with finalize.
+func (h *Handler) uploadSessionCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.uploadSessionsEnabled(w, r) {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("parsing form: %v", err))
+		return
+	}
+	session := uploadSession{Name: r.PostForm.Get("name"), Options: make(url.Values)}
+	if session.Name == "" {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "missing name field")
+		return
+	}
+	opts, err := parseUploadOptions(r.PostForm)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	for k, vs := range r.PostForm {
+		if k != "name" && k != "path" && k != "length" {
+			session.Options[k] = vs
+		}
+	}
+	files, err := parseUploadFileFields(r.PostForm, opts.stripTopDirectory)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	for _, fi := range files {
+		session.Files = append(session.Files, uploadSessionFile{Path: fi.Path, Length: fi.Length})
+	}
+	h.expireUploadSessions()
+	id, err := h.newUploadSession(&session)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, fmt.Sprintf("creating session: %v", err))
+		return
+	}
+	w.Header().Set("Location", "/upload/sessions/"+id)
+	h.writeUploadSession(w, r, http.StatusCreated, id, &session)
+}
+
+func (h *Handler) uploadSessionsEnabled(w http.ResponseWriter, r *http.Request) bool {
+	if h.UploadSessionDir == "" {
+		httpError(w, r, http.StatusNotFound, ErrorCodeNotFound, "upload sessions aren't enabled")
+		return false
+	}
+	return true
+}
+
+func (h *Handler) newUploadSession(session *uploadSession) (id string, err error) {
+	var b [16]byte
+	rand.Read(b[:])
+	id = hex.EncodeToString(b[:])
+	err = os.MkdirAll(h.uploadSessionPath(id), 0o750)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(h.uploadSessionPath(id))
+		}
+	}()
+	for i := range session.Files {
+		err = os.WriteFile(h.uploadSessionDataPath(id, i), nil, 0o640)
+		if err != nil {
+			return
+		}
+	}
+	// Written last, so sessions are only loaded once they're complete.
+	sessionJson, err := json.Marshal(session)
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(h.uploadSessionPath(id, uploadSessionFileName), sessionJson, 0o640)
+	return
+}
+
+// Removes sessions that haven't been written to within the expiry. Only directories named as
+// session ids are considered, and those without a session file are only removed once they're as
+// old as the expiry, as they might still be being created.
+func (h *Handler) expireUploadSessions() {
+	entries, err := os.ReadDir(h.UploadSessionDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !validUploadSessionId(e.Name()) {
+			continue
+		}
+		if h.uploadSessionModified(e.Name()).Add(h.uploadSessionExpiry()).After(time.Now()) {
+			continue
+		}
+		done, err := h.lockUploadSession(e.Name(), true)
+		if err != nil {
+			continue
+		}
+		// Checked again, as chunks may have been written before the lock was held.
+		if !h.uploadSessionModified(e.Name()).Add(h.uploadSessionExpiry()).After(time.Now()) {
+			os.RemoveAll(h.uploadSessionPath(e.Name()))
+		}
+		done()
+	}
+}
+
+// Returns when the session was last written to, which is when its directory or session file was
+// last modified, whichever is later. It's the zero time if neither exists.
+func (h *Handler) uploadSessionModified(id string) (ret time.Time) {
+	for _, name := range []string{"", uploadSessionFileName} {
+		fi, err := os.Stat(h.uploadSessionPath(id, name))
+		if err == nil && fi.ModTime().After(ret) {
+			ret = fi.ModTime()
+		}
+	}
+	return
+}
+
+// Session ids are used in paths, so they can't be trusted as given.
+func validUploadSessionId(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == 16
+}
+
+// Loads the session for the request's id wildcard, responding with an error if it doesn't exist or
+// has expired.
+func (h *Handler) loadUploadSession(w http.ResponseWriter, r *http.Request) (
+	id string, session uploadSession, ok bool,
+) {
+	if !h.uploadSessionsEnabled(w, r) {
+		return
+	}
+	id = r.PathValue("id")
+	notFound := func() {
+		httpError(w, r, http.StatusNotFound, ErrorCodeNotFound, "no upload session with that id")
+	}
+	if !validUploadSessionId(id) {
+		notFound()
+		return
+	}
+	sessionPath := h.uploadSessionPath(id, uploadSessionFileName)
+	fi, err := os.Stat(sessionPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		notFound()
+		return
+	}
+	// Expired sessions are left to expireUploadSessions to remove.
+	if err == nil && time.Since(fi.ModTime()) >= h.uploadSessionExpiry() {
+		notFound()
+		return
+	}
+	b, err := os.ReadFile(sessionPath)
+	if err == nil {
+		err = json.Unmarshal(b, &session)
+	}
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, fmt.Sprintf("loading session: %v", err))
+		return
+	}
+	ok = true
+	return
+}
+
+func (h *Handler) writeUploadSession(w http.ResponseWriter, r *http.Request, status int, id string, session *uploadSession) {
+	fi, err := os.Stat(h.uploadSessionPath(id, uploadSessionFileName))
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
+	}
+	ret := uploadSessionJson{
+		Id:      id,
+		Expires: fi.ModTime().Add(h.uploadSessionExpiry()),
+		Files:   make([]uploadSessionFileJson, 0, len(session.Files)),
+	}
+	for i, f := range session.Files {
+		fi, err := os.Stat(h.uploadSessionDataPath(id, i))
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		}
+		ret.Files = append(ret.Files, uploadSessionFileJson{
+			Path:     strings.Join(f.Path, "/"),
+			Length:   f.Length,
+			Received: fi.Size(),
+		})
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ret)
+}
+
+func (h *Handler) uploadSessionGetHandler(w http.ResponseWriter, r *http.Request) {
+	id, session, ok := h.loadUploadSession(w, r)
+	if !ok {
+		return
+	}
+	h.writeUploadSession(w, r, http.StatusOK, id, &session)
+}
+
+func (h *Handler) uploadSessionDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	done, err := h.lockUploadSession(r.PathValue("id"), true)
+	if err != nil {
+		httpError(w, r, http.StatusConflict, ErrorCodeConflict, err.Error())
+		return
+	}
+	defer done()
+	id, _, ok := h.loadUploadSession(w, r)
+	if !ok {
+		return
+	}
+	err = os.RemoveAll(h.uploadSessionPath(id))
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Writes the body to a file of the session at the offset query parameter. The offset can't be past
+// the data already received, so there are no gaps. Data that's received before the request fails is
+// kept, and the upload can be resumed from the file's received length.
+func (h *Handler) uploadSessionChunkHandler(w http.ResponseWriter, r *http.Request) {
+	// Before loading the session, so it can't be finalized and removed in between.
+	done, err := h.lockUploadSession(r.PathValue("id"), false)
+	if err != nil {
+		httpError(w, r, http.StatusConflict, ErrorCodeConflict, err.Error())
+		return
+	}
+	defer done()
+	id, session, ok := h.loadUploadSession(w, r)
+	if !ok {
+		return
+	}
+	index, err := strconv.Atoi(r.PathValue("file"))
+	if err != nil || index < 0 || index >= len(session.Files) {
+		httpError(w, r, http.StatusNotFound, ErrorCodeFileNotFound, "no file in the session with that index")
+		return
+	}
+	file := session.Files[index]
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "invalid offset")
+		return
+	}
+	dataPath := h.uploadSessionDataPath(id, index)
+	f, err := os.OpenFile(dataPath, os.O_WRONLY, 0)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
+	}
+	if offset > fi.Size() {
+		httpError(w, r, http.StatusConflict, ErrorCodeConflict, fmt.Sprintf(
+			"offset %v is past the %v bytes received", offset, fi.Size()))
+		return
+	}
+	if r.ContentLength > file.Length-offset {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "chunk extends past the end of the file")
+		return
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err == nil {
+		_, err = io.Copy(f, io.LimitReader(r.Body, file.Length-offset))
+	}
+	// Refresh the expiry even if only part of the chunk was received.
+	now := time.Now()
+	os.Chtimes(h.uploadSessionPath(id, uploadSessionFileName), now, now)
+	if err != nil {
+		if r.Context().Err() != nil {
+			httpError(w, r, httptoo.StatusClientCancelledRequest, ErrorCodeRequestCanceled, "request canceled")
+			return
+		}
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("receiving chunk: %v", err))
+		return
+	}
+	if n, _ := io.CopyN(io.Discard, r.Body, 1); n != 0 {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "chunk extends past the end of the file")
+		return
+	}
+	h.writeUploadSession(w, r, http.StatusOK, id, &session)
+}
+
+// Registers a chunk being written to the upload session with the id, or that it's being finalized
+// or removed, which excludes anything else. The returned func must be called when that's done.
+func (h *Handler) lockUploadSession(id string, exclusive bool) (done func(), err error) {
+	h.uploadsMu.Lock()
+	defer h.uploadsMu.Unlock()
+	writers := h.uploadSessionWriters[id]
+	if writers < 0 {
+		return nil, errors.New("session is being finalized or removed")
+	}
+	if exclusive && writers != 0 {
+		return nil, errors.New("chunks are being written to the session")
+	}
+	if h.uploadSessionWriters == nil {
+		h.uploadSessionWriters = make(map[string]int)
+	}
+	delta := 1
+	if exclusive {
+		delta = -1
+	}
+	h.uploadSessionWriters[id] += delta
+	return func() {
+		h.uploadsMu.Lock()
+		defer h.uploadsMu.Unlock()
+		h.uploadSessionWriters[id] -= delta
+		if h.uploadSessionWriters[id] == 0 {
+			delete(h.uploadSessionWriters, id)
+		}
+	}, nil
+}
+
+// Creates the torrent from the session's files once they're all received, and stores it as for
+// uploadHandler. The session is removed if that succeeds.
+func (h *Handler) uploadSessionFinalizeHandler(w http.ResponseWriter, r *http.Request) {
+	done, err := h.lockUploadSession(r.PathValue("id"), true)
+	if err != nil {
+		httpError(w, r, http.StatusConflict, ErrorCodeConflict, err.Error())
+		return
+	}
+	defer done()
+	id, session, ok := h.loadUploadSession(w, r)
+	if !ok {
+		return
+	}
+	opts, err := parseUploadOptions(session.Options)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	info := metainfo.Info{Name: session.Name}
+	files := make([]localFile, 0, len(session.Files))
+	for i, f := range session.Files {
+		fi, err := os.Stat(h.uploadSessionDataPath(id, i))
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		}
+		if fi.Size() != f.Length {
+			httpError(w, r, http.StatusConflict, ErrorCodeConflict, fmt.Sprintf(
+				"file %q has %v of %v bytes", strings.Join(f.Path, "/"), fi.Size(), f.Length))
+			return
+		}
+		files = append(files, localFile{osPath: h.uploadSessionDataPath(id, i), length: f.Length})
+		info.Files = append(info.Files, metainfo.FileInfo{
+			Length:   f.Length,
+			Path:     f.Path,
+			PathUtf8: f.Path,
+		})
+	}
+	if opts.sortFiles {
+		err = sortFileTreeOrder(info.Files, files)
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
+		}
+	}
+	info.PieceLength = opts.pieceLength
+	if info.PieceLength == 0 {
+		info.PieceLength = metainfo.ChoosePieceLength(info.TotalLength())
+	}
+	pieceLayers, err := hashLocalFiles(r.Context(), &info, files, opts.version)
+	if err != nil {
+		if r.Context().Err() != nil {
+			httpError(w, r, httptoo.StatusClientCancelledRequest, ErrorCodeRequestCanceled, "request canceled")
+			return
+		}
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, fmt.Sprintf("hashing files: %v", err))
+		return
+	}
+	var alignment int64
+	if info.FilesArePieceAligned() {
+		alignment = info.PieceLength
+	}
+	data, closeData, err := openLocalFiles(files, alignment)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
+	}
+	defer closeData()
+	if h.completeUpload(w, r, &info, &opts, pieceLayers, data, nil) {
+		os.RemoveAll(h.uploadSessionPath(id))
+	}
+}
@@ -0,0 +1,282 @@
+package confluence
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+func createTestUploadSession(t *testing.T, h http.Handler, form url.Values) uploadSessionJson {
+	r := httptest.NewRequest(http.MethodPost, "/upload/sessions", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return testJsonRequest[uploadSessionJson](t, h, r, http.StatusCreated)
+}
+
+func putTestUploadChunk(h http.Handler, id string, file int, offset int64, body io.Reader) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(
+		http.MethodPut,
+		"/upload/sessions/"+id+"/files/"+strconv.Itoa(file)+"?offset="+strconv.FormatInt(offset, 10),
+		body))
+	return w
+}
+
+func getTestUploadSession(t *testing.T, h http.Handler, id string) uploadSessionJson {
+	return testJsonRequest[uploadSessionJson](t, h, httptest.NewRequest(http.MethodGet, "/upload/sessions/"+id, nil), http.StatusOK)
+}
+
+// Fails a request body part way, like a dropped connection.
+type interruptedReader struct{}
+
+func (interruptedReader) Read([]byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestUploadSession(t *testing.T) {
+	files := map[string]string{
+		"a":     strings.Repeat("a", 20000),
+		"dir/b": strings.Repeat("b", 30000),
+	}
+	for _, version := range []string{uploadVersionV1, uploadVersionV2, uploadVersionHybrid} {
+		sessionDir := t.TempDir()
+		h := testingHandler(t)
+		h.UploadSessionDir = sessionDir
+		session := createTestUploadSession(t, h, url.Values{
+			"name":         {"test"},
+			"version":      {version},
+			"piece-length": {"16384"},
+			"file-order":   {"path"},
+			"path":         {"dir/b", "a"},
+			"length":       {"30000", "20000"},
+		})
+		id := session.Id
+		if len(session.Files) != 2 || session.Files[0].Path != "dir/b" || session.Files[0].Received != 0 {
+			t.Fatalf("%v: %+v", version, session)
+		}
+		b := files["dir/b"]
+		// The connection drops part way through a chunk, and what arrived is kept.
+		w := putTestUploadChunk(h, id, 0, 0, io.MultiReader(strings.NewReader(b[:12345]), interruptedReader{}))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%v: interrupted chunk: %v %q", version, w.Code, w.Body.String())
+		}
+		// Confluence restarts, and the session is resumed from disk.
+		h = testingHandler(t)
+		h.UploadSessionDir = sessionDir
+		received := getTestUploadSession(t, h, id).Files[0].Received
+		if received != 12345 {
+			t.Fatalf("%v: received %v", version, received)
+		}
+		// Chunks can't leave gaps.
+		w = putTestUploadChunk(h, id, 0, received+1, strings.NewReader(b[received+1:]))
+		if w.Code != http.StatusConflict {
+			t.Fatalf("%v: chunk past received: %v %q", version, w.Code, w.Body.String())
+		}
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/upload/sessions/"+id+"/finalize", nil))
+		if w.Code != http.StatusConflict {
+			t.Fatalf("%v: finalizing early: %v %q", version, w.Code, w.Body.String())
+		}
+		// Resending some of what was received is fine.
+		for _, chunk := range []struct {
+			file   int
+			offset int64
+			data   string
+		}{
+			{0, received - 100, b[received-100 : 20000]},
+			{0, 20000, b[20000:]},
+			{1, 0, files["a"]},
+		} {
+			w = putTestUploadChunk(h, id, chunk.file, chunk.offset, strings.NewReader(chunk.data))
+			if w.Code != http.StatusOK {
+				t.Fatalf("%v: chunk: %v %q", version, w.Code, w.Body.String())
+			}
+		}
+		w = putTestUploadChunk(h, id, 1, 0, strings.NewReader(files["a"]+"extra"))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%v: chunk past end: %v %q", version, w.Code, w.Body.String())
+		}
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/upload/sessions/"+id+"/finalize", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: finalizing: %v %q", version, w.Code, w.Body.String())
+		}
+		mi, err := metainfo.Load(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := testUploadMetainfo(t, testingHandler(t), map[string]string{
+			"name":         "test",
+			"version":      version,
+			"piece-length": "16384",
+			"file-order":   "path",
+		}, files)
+		if string(mi.InfoBytes) != string(expected.InfoBytes) {
+			t.Fatalf("%v: info differs from upload", version)
+		}
+		ih, _ := metainfoCanonicalInfohash(mi)
+		for p, data := range files {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/data/infohash/"+ih+"/"+p, nil))
+			if w.Body.String() != data {
+				t.Errorf("%v: %v: %v %q", version, p, w.Code, w.Body.String())
+			}
+		}
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/upload/sessions/"+id, nil))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("%v: session after finalizing: %v", version, w.Code)
+		}
+	}
+}
+
+func TestUploadSessionExpiry(t *testing.T) {
+	h := testingHandler(t)
+	h.UploadSessionDir = t.TempDir()
+	form := url.Values{"name": {"test"}, "path": {"a"}, "length": {"1"}}
+	old := time.Now().Add(-25 * time.Hour)
+	age := func(id string) {
+		os.Chtimes(h.uploadSessionPath(id, uploadSessionFileName), old, old)
+		os.Chtimes(h.uploadSessionPath(id), old, old)
+	}
+	expired := createTestUploadSession(t, h, form)
+	age(expired.Id)
+	w := putTestUploadChunk(h, expired.Id, 0, 0, strings.NewReader("a"))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("chunk for expired session: %v %q", w.Code, w.Body.String())
+	}
+	// Directories that aren't sessions are left alone, as are sessions still being created.
+	unrelated := filepath.Join(h.UploadSessionDir, "unrelated")
+	os.Mkdir(unrelated, 0o750)
+	os.Chtimes(unrelated, old, old)
+	creating := strings.Repeat("ab", 16)
+	os.Mkdir(h.uploadSessionPath(creating), 0o750)
+	// Creating sessions removes expired ones.
+	live := createTestUploadSession(t, h, form)
+	var names []string
+	entries, _ := os.ReadDir(h.UploadSessionDir)
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := []string{creating, live.Id, "unrelated"}
+	slices.Sort(names)
+	slices.Sort(want)
+	if !slices.Equal(names, want) {
+		t.Fatalf("sessions are %q, expected %q", names, want)
+	}
+	os.Remove(unrelated)
+	os.Remove(h.uploadSessionPath(creating))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/upload/sessions/"+live.Id, nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("deleting session: %v %q", w.Code, w.Body.String())
+	}
+	entries, _ = os.ReadDir(h.UploadSessionDir)
+	if len(entries) != 0 {
+		t.Fatalf("unexpected sessions: %v", entries)
+	}
+}
+
+func TestUploadSessionsDisabled(t *testing.T) {
+	h := testingHandler(t)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/upload/sessions/00000000000000000000000000000000", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("%v %q", w.Code, w.Body.String())
+	}
+}
+
+// Blocks writes until released.
+type blockingPiece struct {
+	storage.PieceImpl
+	writing chan<- struct{}
+	release <-chan struct{}
+}
+
+func (me blockingPiece) WriteAt(b []byte, off int64) (int, error) {
+	me.writing <- struct{}{}
+	<-me.release
+	return me.PieceImpl.WriteAt(b, off)
+}
+
+// A session can't be finalized while chunks are written to it, or written to while it's finalized.
+func TestUploadSessionFinalizeDuringChunk(t *testing.T) {
+	h := testingHandler(t)
+	h.UploadSessionDir = t.TempDir()
+	writing := make(chan struct{})
+	release := make(chan struct{})
+	h.Storage = storage.NewClient(pieceWrappingStorage{
+		storage.NewFileOpts(storage.NewFileClientOpts{
+			ClientBaseDir:   t.TempDir(),
+			PieceCompletion: storage.NewMapPieceCompletion(),
+		}),
+		func(p metainfo.Piece, pi storage.PieceImpl) storage.PieceImpl {
+			return blockingPiece{pi, writing, release}
+		},
+	})
+	id := createTestUploadSession(t, h, url.Values{
+		"name":   {"test"},
+		"path":   {"a"},
+		"length": {"10"},
+	}).Id
+	sessionRequest := func(method, target string) (int, ErrorCode) {
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set("Accept", jsonContentType)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		var e Error
+		json.Unmarshal(w.Body.Bytes(), &e)
+		return w.Code, e.Code
+	}
+	finalizeTarget := "/upload/sessions/" + id + "/finalize"
+	// The first half of the file is received, and the chunk is still being written.
+	pr, pw := io.Pipe()
+	chunkDone := make(chan *httptest.ResponseRecorder)
+	go func() {
+		chunkDone <- putTestUploadChunk(h, id, 0, 0, pr)
+	}()
+	io.WriteString(pw, "hello")
+	for getTestUploadSession(t, h, id).Files[0].Received != 5 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, method := range []string{http.MethodPost, http.MethodDelete} {
+		target := finalizeTarget
+		if method == http.MethodDelete {
+			target = "/upload/sessions/" + id
+		}
+		if status, code := sessionRequest(method, target); status != http.StatusConflict || code != ErrorCodeConflict {
+			t.Fatalf("%v during chunk: %v %v", method, status, code)
+		}
+	}
+	io.WriteString(pw, "world")
+	pw.Close()
+	if w := <-chunkDone; w.Code != http.StatusOK {
+		t.Fatalf("chunk: %v %q", w.Code, w.Body.String())
+	}
+	// Finalizing blocks storing the first piece, and the same chunk is sent again.
+	finalizeDone := make(chan int)
+	go func() {
+		status, _ := sessionRequest(http.MethodPost, finalizeTarget)
+		finalizeDone <- status
+	}()
+	<-writing
+	w := putTestUploadChunk(h, id, 0, 0, strings.NewReader("helloworld"))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("chunk during finalize: %v %q", w.Code, w.Body.String())
+	}
+	close(release)
+	if status := <-finalizeDone; status != http.StatusOK {
+		t.Fatalf("finalize: %v", status)
+	}
+}
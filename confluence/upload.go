@@ -0,0 +1,575 @@
+package confluence
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/anacrolix/missinggo/v2/httptoo"
+	"github.com/anacrolix/torrent/metainfo"
+	infohash_v2 "github.com/anacrolix/torrent/types/infohash-v2"
+)
+
+// The state of an upload in progress, for GET /upload/progress. A nil uploadProgress ignores
+// updates.
+type uploadProgress struct {
+	files         atomic.Int64
+	bytesReceived atomic.Int64
+	// Set once all the files are received and hashed, and the pieces are being stored.
+	pieces       atomic.Int64
+	piecesStored atomic.Int64
+}
+
+func (me *uploadProgress) Write(b []byte) (int, error) {
+	me.bytesReceived.Add(int64(len(b)))
+	return len(b), nil
+}
+
+func (me *uploadProgress) storing(pieces int) {
+	if me != nil {
+		me.pieces.Store(int64(pieces))
+	}
+}
+
+func (me *uploadProgress) pieceStored() {
+	if me != nil {
+		me.piecesStored.Add(1)
+	}
+}
+
+func (me *uploadProgress) MarshalJSON() ([]byte, error) {
+	phase := "receiving"
+	if me.pieces.Load() != 0 {
+		phase = "storing"
+	}
+	return json.Marshal(struct {
+		Phase         string `json:"phase"`
+		Files         int64  `json:"files"`
+		BytesReceived int64  `json:"bytesReceived"`
+		Pieces        int64  `json:"pieces,omitempty"`
+		PiecesStored  int64  `json:"piecesStored"`
+	}{
+		Phase:         phase,
+		Files:         me.files.Load(),
+		BytesReceived: me.bytesReceived.Load(),
+		Pieces:        me.pieces.Load(),
+		PiecesStored:  me.piecesStored.Load(),
+	})
+}
+
+// Registers the progress of an upload under the client's ID until the returned func is called.
+func (h *Handler) trackUpload(id string) (progress *uploadProgress, done func(), err error) {
+	h.uploadsMu.Lock()
+	defer h.uploadsMu.Unlock()
+	if _, ok := h.uploads[id]; ok {
+		return nil, nil, fmt.Errorf("upload %q is already in progress", id)
+	}
+	if h.uploads == nil {
+		h.uploads = make(map[string]*uploadProgress)
+	}
+	progress = new(uploadProgress)
+	h.uploads[id] = progress
+	return progress, func() {
+		h.uploadsMu.Lock()
+		defer h.uploadsMu.Unlock()
+		delete(h.uploads, id)
+	}, nil
+}
+
+func (h *Handler) uploadProgressHandler(w http.ResponseWriter, r *http.Request) {
+	h.uploadsMu.Lock()
+	progress, ok := h.uploads[r.URL.Query().Get("id")]
+	h.uploadsMu.Unlock()
+	if !ok {
+		httpError(w, r, http.StatusNotFound, ErrorCodeNotFound, "no upload in progress with that id")
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	json.NewEncoder(w).Encode(progress)
+}
+
+// A file of an upload as it was received.
+type receivedUploadFile struct {
+	// Has the filename, see uploadFilePath.
+	header  textproto.MIMEHeader
+	spooled localFile
+	// Nil if the file wasn't hashed as it was received, or for v1 torrents, where pieces span files.
+	hasher *v2FileHasher
+}
+
+// Creates a torrent from an upload's multipart form as it arrives. Storage needs the infohash, so
+// the data can't be stored until all of it is hashed, and it's written once to a spool in
+// Handler.UploadSpoolDir in the meantime. Files are hashed as they're received if the fields giving
+// the version and piece length precede them, and then the spool is only read to store them.
+// Otherwise, and if v1 files are reordered, the spool is hashed once the form is received.
+func (h *Handler) receiveUpload(w http.ResponseWriter, r *http.Request, progress *uploadProgress) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	spoolDir, err := h.newUploadSpool()
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, fmt.Sprintf("creating spool: %v", err))
+		return
+	}
+	defer os.RemoveAll(spoolDir)
+	var (
+		fields = make(url.Values)
+		files  []receivedUploadFile
+		// The options the files are hashed with as they're received, if they're known in time.
+		hashOpts *uploadOptions
+		// Hashes all the data for v1 torrents.
+		v1 *v1PieceHasher
+	)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("reading multipart form: %v", err))
+			return
+		}
+		name := part.FormName()
+		if name != "files" {
+			b, err := io.ReadAll(io.LimitReader(part, maxUploadFieldLength+1))
+			if err != nil {
+				httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("reading field %q: %v", name, err))
+				return
+			}
+			if len(b) > maxUploadFieldLength {
+				httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("field %q is too long", name))
+				return
+			}
+			fields.Add(name, string(b))
+			continue
+		}
+		if files == nil {
+			// Fields can't be removed, so invalid options won't be valid later.
+			opts, err := parseUploadOptions(fields)
+			if err != nil {
+				httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+				return
+			}
+			if opts.pieceLength != 0 {
+				hashOpts = &opts
+				if opts.version == "" || opts.version == uploadVersionV1 {
+					v1 = newV1PieceHasher(opts.pieceLength)
+				}
+			}
+		}
+		file := receivedUploadFile{header: part.Header}
+		// Checked now to fail early, but the path depends on options that may follow.
+		_, err = uploadFilePath(part.Header, false)
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
+		}
+		var hasher io.Writer
+		if v1 != nil {
+			hasher = v1
+		} else if hashOpts != nil {
+			file.hasher = newV2FileHasher(hashOpts.pieceLength, hashOpts.version == uploadVersionHybrid)
+			hasher = file.hasher
+		}
+		file.spooled, err = spoolUploadFile(spoolDir, len(files), part, hasher, progress)
+		if err != nil {
+			// Only writing the spool fails with a PathError, anything else is from the body.
+			status, code := http.StatusBadRequest, ErrorCodeBadRequest
+			if errors.As(err, new(*fs.PathError)) {
+				status, code = http.StatusInternalServerError, ErrorCodeInternal
+			}
+			httpError(w, r, status, code, fmt.Sprintf("receiving file %q: %v", part.FileName(), err))
+			return
+		}
+		files = append(files, file)
+		if progress != nil {
+			progress.files.Add(1)
+		}
+	}
+	info := metainfo.Info{Name: fields.Get("name")}
+	if info.Name == "" {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "missing name field")
+		return
+	}
+	if files == nil {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "no files")
+		return
+	}
+	opts, err := parseUploadOptions(fields)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	// Fields after the files may have changed how they're hashed.
+	if hashOpts != nil && (opts.version != hashOpts.version || opts.pieceLength != hashOpts.pieceLength) {
+		hashOpts = nil
+	}
+	for _, f := range files {
+		path, err := uploadFilePath(f.header, opts.stripTopDirectory)
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
+		}
+		info.Files = append(info.Files, metainfo.FileInfo{
+			Length:   f.spooled.length,
+			Path:     path,
+			PathUtf8: path,
+		})
+	}
+	if opts.sortFiles {
+		order := make([]int, len(files))
+		for i := range order {
+			order[i] = i
+		}
+		err = sortFileTreeOrder(info.Files, order)
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
+		}
+		if v1 != nil && hashOpts != nil && !slices.IsSorted(order) {
+			// The pieces span files in the order they arrived.
+			hashOpts = nil
+		}
+		sorted := make([]receivedUploadFile, 0, len(files))
+		for _, i := range order {
+			sorted = append(sorted, files[i])
+		}
+		files = sorted
+	}
+	spooled := make([]localFile, 0, len(files))
+	for _, f := range files {
+		spooled = append(spooled, f.spooled)
+	}
+	var pieceLayers map[string]string
+	switch {
+	case hashOpts == nil:
+		info.PieceLength = opts.pieceLength
+		if info.PieceLength == 0 {
+			info.PieceLength = metainfo.ChoosePieceLength(info.TotalLength())
+		}
+		pieceLayers, err = hashLocalFiles(r.Context(), &info, spooled, opts.version)
+		if err != nil {
+			if r.Context().Err() != nil {
+				httpError(w, r, httptoo.StatusClientCancelledRequest, ErrorCodeRequestCanceled, "request canceled")
+				return
+			}
+			httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, fmt.Sprintf("hashing files: %v", err))
+			return
+		}
+	case v1 != nil:
+		info.PieceLength = hashOpts.pieceLength
+		info.Pieces = v1.finish(false)
+	default:
+		info.PieceLength = hashOpts.pieceLength
+		hashers := make([]*v2FileHasher, 0, len(files))
+		for _, f := range files {
+			hashers = append(hashers, f.hasher)
+		}
+		pieceLayers = setV2Info(&info, info.Files, hashers)
+	}
+	var alignment int64
+	if info.FilesArePieceAligned() {
+		alignment = info.PieceLength
+	}
+	data, closeData, err := openLocalFiles(spooled, alignment)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		return
+	}
+	defer closeData()
+	h.completeUpload(w, r, &info, &opts, pieceLayers, data, progress)
+}
+
+// Creates a directory for an upload's files in Handler.UploadSpoolDir.
+func (h *Handler) newUploadSpool() (string, error) {
+	dir := h.UploadSpoolDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	err := os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(dir, "upload-")
+}
+
+// Writes an uploaded file to the spool directory, named by its index, and to the hasher if it's not
+// nil.
+func spoolUploadFile(dir string, index int, part io.Reader, hasher io.Writer, progress *uploadProgress) (
+	ret localFile, err error,
+) {
+	ret.osPath = filepath.Join(dir, strconv.Itoa(index))
+	f, err := os.Create(ret.osPath)
+	if err != nil {
+		return
+	}
+	dst := []io.Writer{f}
+	if hasher != nil {
+		dst = append(dst, hasher)
+	}
+	if progress != nil {
+		dst = append(dst, progress)
+	}
+	ret.length, err = io.Copy(io.MultiWriter(dst...), part)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return
+}
+
+// The longest form field accepted by uploads. Fields are small, but tracker and web seed
+// lists can run to many lines.
+const maxUploadFieldLength = 64 << 10
+
+// Per-upload options from the form fields other than the name and files.
+type uploadOptions struct {
+	version string
+	// Zero to choose from the total length of the files.
+	pieceLength       int64
+	stripTopDirectory bool
+	// Order v1 files by path rather than as given. v2 files are always in file tree order.
+	sortFiles    bool
+	private      bool
+	source       string
+	comment      string
+	announceList metainfo.AnnounceList
+	urlList      []string
+}
+
+const (
+	uploadFileOrderForm = "form"
+	uploadFileOrderPath = "path"
+)
+
+// Parses and validates the upload options in form. The trackers field has a tracker URL per line,
+// with blank lines separating tiers, and repeated trackers fields are also separate tiers. The
+// url-list field has a web seed URL per line.
+func parseUploadOptions(form url.Values) (ret uploadOptions, err error) {
+	ret.version = form.Get("version")
+	switch ret.version {
+	case "", uploadVersionV1, uploadVersionV2, uploadVersionHybrid:
+	default:
+		err = fmt.Errorf("unknown torrent version %q", ret.version)
+		return
+	}
+	if s := form.Get("piece-length"); s != "" {
+		ret.pieceLength, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || ret.pieceLength < 1<<14 || ret.pieceLength&(ret.pieceLength-1) != 0 {
+			err = fmt.Errorf("piece length %q isn't a power of two of at least 16 KiB", s)
+			return
+		}
+	}
+	// Raw HTML directory file uploads don't support mixing files and directories with a single
+	// chooser. So if you need to select everything inside a directory, you have to upload the
+	// parent directory itself. This option strips that top-level directory name.
+	_, ret.stripTopDirectory = form["strip-top-directory"]
+	v1 := ret.version == "" || ret.version == uploadVersionV1
+	switch order := form.Get("file-order"); order {
+	case "":
+		ret.sortFiles = !v1
+	case uploadFileOrderForm:
+		if !v1 {
+			err = errors.New("v2 torrents must have files ordered by path")
+			return
+		}
+	case uploadFileOrderPath:
+		ret.sortFiles = true
+	default:
+		err = fmt.Errorf("unknown file order %q", order)
+		return
+	}
+	if s := form.Get("private"); s != "" {
+		ret.private, err = strconv.ParseBool(s)
+		if err != nil {
+			err = fmt.Errorf("parsing private: %w", err)
+			return
+		}
+	}
+	ret.source = form.Get("source")
+	ret.comment = form.Get("comment")
+	for _, field := range form["trackers"] {
+		var tier []string
+		for _, line := range strings.Split(field, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				if len(tier) != 0 {
+					ret.announceList = append(ret.announceList, tier)
+					tier = nil
+				}
+				continue
+			}
+			err = validateUploadUrl(line, "http", "https", "udp", "ws", "wss")
+			if err != nil {
+				err = fmt.Errorf("invalid tracker: %w", err)
+				return
+			}
+			tier = append(tier, line)
+		}
+		if len(tier) != 0 {
+			ret.announceList = append(ret.announceList, tier)
+		}
+	}
+	for _, field := range form["url-list"] {
+		for _, line := range strings.Fields(field) {
+			err = validateUploadUrl(line, "http", "https")
+			if err != nil {
+				err = fmt.Errorf("invalid web seed: %w", err)
+				return
+			}
+			ret.urlList = append(ret.urlList, line)
+		}
+	}
+	return
+}
+
+// Checks s is an absolute URL with one of the schemes and a host.
+func validateUploadUrl(s string, schemes ...string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(schemes, u.Scheme) {
+		return fmt.Errorf("%q: scheme isn't one of %q", s, schemes)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q: missing host", s)
+	}
+	return nil
+}
+
+// Splits a file path given for an upload into its components. Components that are empty, or refer
+// to the current or parent directory, are rejected, as they're invalid in metainfos and could
+// escape the torrent's directory in file storage.
+func splitUploadPath(p string, stripTopDirectory bool) ([]string, error) {
+	path := strings.Split(p, "/")
+	// If the path only has a single component, it's a file in the top-level directory.
+	if len(path) > 1 && stripTopDirectory {
+		path = path[1:]
+	}
+	for _, c := range path {
+		if c == "" || c == "." || c == ".." {
+			return nil, fmt.Errorf("invalid file path %q", p)
+		}
+	}
+	return path, nil
+}
+
+// Parses the files of an upload described by path and length fields for each file in order, rather
+// than sent with it.
+func parseUploadFileFields(form url.Values, stripTopDirectory bool) (files []metainfo.FileInfo, err error) {
+	paths, lengths := form["path"], form["length"]
+	if len(paths) == 0 || len(paths) != len(lengths) {
+		err = errors.New("expected a path and length for each file")
+		return
+	}
+	for i, p := range paths {
+		length, parseErr := strconv.ParseInt(lengths[i], 10, 64)
+		if parseErr != nil || length < 0 {
+			err = fmt.Errorf("invalid length %q", lengths[i])
+			return
+		}
+		path, pathErr := splitUploadPath(p, stripTopDirectory)
+		if pathErr != nil {
+			err = pathErr
+			return
+		}
+		files = append(files, metainfo.FileInfo{
+			Length:   length,
+			Path:     path,
+			PathUtf8: path,
+		})
+	}
+	return
+}
+
+// Sets the fields of the info given by the options, which change the infohash. The piece length
+// and files are handled by the upload handlers, as they depend on how the files are hashed.
+func (me *uploadOptions) setInfo(info *metainfo.Info) {
+	if me.private {
+		private := true
+		info.Private = &private
+	}
+	info.Source = me.source
+}
+
+// Sets the metainfo fields given by the options, which are outside the info.
+func (me *uploadOptions) setMetainfo(mi *metainfo.MetaInfo) {
+	mi.Comment = me.comment
+	if len(me.announceList) != 0 {
+		mi.Announce = me.announceList[0][0]
+		if len(me.announceList) > 1 || len(me.announceList[0]) > 1 {
+			mi.AnnounceList = me.announceList
+		}
+	}
+	mi.UrlList = me.urlList
+}
+
+// The response to an upload for clients that accept JSON, so they don't need to decode the metainfo.
+type uploadResultJson struct {
+	// The v1 infohash, or the v2 infohash for v2 only torrents, as used in URLs.
+	Infohash string `json:"infohash"`
+	// Set for v2 and hybrid torrents.
+	InfohashV2 string `json:"infohashV2,omitempty"`
+	Name       string `json:"name"`
+	Length     int64  `json:"length"`
+	Magnet     string `json:"magnet"`
+	// The data of the whole torrent. Omitted if there's padding between files, which isn't stored.
+	DataUrl string           `json:"dataUrl,omitempty"`
+	Files   []uploadFileJson `json:"files"`
+}
+
+type uploadFileJson struct {
+	// The display path, as used in data URLs.
+	Path    string `json:"path"`
+	Length  int64  `json:"length"`
+	DataUrl string `json:"dataUrl"`
+}
+
+func (h *Handler) writeUploadJson(
+	w http.ResponseWriter, r *http.Request, info *metainfo.Info, mi *metainfo.MetaInfo, enriched bool,
+) {
+	ih, _ := metainfoCanonicalInfohash(mi)
+	magnet, err := h.metainfoMagnet(r, mi, enriched)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, ErrorCodeInternal, fmt.Sprintf("making magnet: %v", err))
+		return
+	}
+	dataUrl := h.baseUrl(r).JoinPath("data", "infohash", ih)
+	ret := uploadResultJson{
+		Infohash: ih,
+		Name:     info.BestName(),
+		Length:   info.TotalLength(),
+		Magnet:   magnet,
+		Files:    []uploadFileJson{},
+	}
+	if info.HasV2() {
+		v2 := infohash_v2.HashBytes(mi.InfoBytes)
+		ret.InfohashV2 = v2.HexString()
+	}
+	for _, f := range info.UpvertedFiles() {
+		ret.Files = append(ret.Files, uploadFileJson{
+			Path:    f.DisplayPath(info),
+			Length:  f.Length,
+			DataUrl: dataUrl.JoinPath(f.BestPath()...).String(),
+		})
+	}
+	if !info.FilesArePieceAligned() || len(ret.Files) == 1 {
+		ret.DataUrl = dataUrl.String()
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	json.NewEncoder(w).Encode(ret)
+}
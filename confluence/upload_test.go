@@ -0,0 +1,433 @@
+package confluence
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	g "github.com/anacrolix/generics"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	infohash_v2 "github.com/anacrolix/torrent/types/infohash-v2"
+)
+
+// Writes a multipart upload form with the fields and then the files in the order given, as pairs of
+// names and values, or paths and contents.
+func writeStreamUploadForm(w io.Writer, fields, files [][2]string) *multipart.Writer {
+	mw := multipart.NewWriter(w)
+	for _, f := range fields {
+		mw.WriteField(f[0], f[1])
+	}
+	for _, f := range files {
+		fw, _ := mw.CreateFormFile("files", f[0])
+		io.WriteString(fw, f[1])
+	}
+	mw.Close()
+	return mw
+}
+
+func testUploadForm(t *testing.T, h http.Handler, fields, files [][2]string) *metainfo.MetaInfo {
+	var body bytes.Buffer
+	mw := writeStreamUploadForm(&body, fields, files)
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return testMetainfoRequest(t, h, r)
+}
+
+// Uploads hashed as they arrive, as the piece length precedes the files, produce the same torrents as
+// those hashed once they're received, and store the data.
+func TestUploadHashedOnArrival(t *testing.T) {
+	files := [][2]string{
+		// Out of file tree order, which v2 torrents use.
+		{"dir/b", "world"},
+		{"a", strings.Repeat("hello", 10000)},
+		{"empty", ""},
+	}
+	filesMap := make(map[string]string)
+	for _, f := range files {
+		filesMap[f[0]] = f[1]
+	}
+	for _, version := range []string{uploadVersionV1, uploadVersionV2, uploadVersionHybrid} {
+		t.Run(version, func(t *testing.T) {
+			files := files
+			if version == uploadVersionV1 {
+				// newUploadRequest sends files in path order, and v1 torrents keep it.
+				files = [][2]string{files[1], files[0], files[2]}
+			}
+			hashedAfter := testUploadMetainfo(t, testingHandler(t), map[string]string{"name": "test", "version": version}, filesMap)
+			info, err := hashedAfter.UnmarshalInfo()
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := testingHandler(t)
+			mi := testUploadForm(t, h, [][2]string{
+				{"name", "test"},
+				{"version", version},
+				{"piece-length", strconv.FormatInt(info.PieceLength, 10)},
+			}, files)
+			if !bytes.Equal(mi.InfoBytes, hashedAfter.InfoBytes) {
+				t.Fatalf("info differs:\n%q\n%q", mi.InfoBytes, hashedAfter.InfoBytes)
+			}
+			if len(mi.PieceLayers) != len(hashedAfter.PieceLayers) {
+				t.Fatalf("%v piece layers, expected %v", len(mi.PieceLayers), len(hashedAfter.PieceLayers))
+			}
+			for k, v := range hashedAfter.PieceLayers {
+				if mi.PieceLayers[k] != v {
+					t.Fatal("piece layers differ")
+				}
+			}
+			ih := mi.HashInfoBytes().HexString()
+			if !info.HasV1() {
+				v2 := infohash_v2.HashBytes(mi.InfoBytes)
+				ih = v2.HexString()
+			}
+			for path, data := range filesMap {
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/data/infohash/"+ih+"/"+path, nil))
+				if w.Code != http.StatusOK || w.Body.String() != data {
+					t.Errorf("%v: got %v with %v bytes", path, w.Code, w.Body.Len())
+				}
+			}
+		})
+	}
+}
+
+// Progress is reported while the files are received.
+func TestUploadProgress(t *testing.T) {
+	h := testingHandler(t)
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	r := httptest.NewRequest(http.MethodPost, "/upload?id=test", pr)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(w, r)
+	}()
+	mw.WriteField("name", "test")
+	mw.WriteField("piece-length", "16384")
+	fw, _ := mw.CreateFormFile("files", "a")
+	io.WriteString(fw, "hello")
+	getProgress := func() (code int, progress map[string]any) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/upload/progress?id=test", nil))
+		json.Unmarshal(w.Body.Bytes(), &progress)
+		return w.Code, progress
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		code, progress := getProgress()
+		if code == http.StatusOK && progress["bytesReceived"] == float64(5) {
+			if progress["phase"] != "receiving" {
+				t.Fatalf("progress: %v", progress)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("progress: %v %v", code, progress)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Another upload can't use the same id while it's in progress.
+	w2 := httptest.NewRecorder()
+	r2 := httptest.NewRequest(http.MethodPost, "/upload?id=test", strings.NewReader(""))
+	r2.Header.Set("Accept", "application/json")
+	h.ServeHTTP(w2, r2)
+	var e Error
+	json.Unmarshal(w2.Body.Bytes(), &e)
+	if w2.Code != http.StatusConflict || e.Code != ErrorCodeConflict {
+		t.Fatalf("duplicate id: %v %q", w2.Code, w2.Body.String())
+	}
+	io.WriteString(fw, " world")
+	mw.Close()
+	pw.Close()
+	<-done
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload: %v %q", w.Code, w.Body.String())
+	}
+	if code, _ := getProgress(); code != http.StatusNotFound {
+		t.Fatalf("progress after upload: %v", code)
+	}
+}
+
+// Upload options are reflected in the metainfo, whether files are hashed as they arrive or after.
+func TestUploadOptions(t *testing.T) {
+	fields := [][2]string{
+		{"name", "test"},
+		{"piece-length", "32768"},
+		{"private", "1"},
+		{"source", "test source"},
+		{"comment", "hello"},
+		{"trackers", "http://a.example/announce\nudp://b.example:1337\n\nwss://c.example/announce"},
+		{"trackers", "https://d.example/announce"},
+		{"url-list", "https://e.example/\nhttp://f.example/files/"},
+		{"file-order", "path"},
+	}
+	files := [][2]string{{"a", strings.Repeat("hello", 10000)}, {"b", "world"}}
+	var infoBytes []byte
+	// Files that arrive out of path order are hashed again once they're all received.
+	for _, order := range [][][2]string{files, {files[1], files[0]}} {
+		first := order[0][0]
+		mi := testUploadForm(t, testingHandler(t), fields, order)
+		info, err := mi.UnmarshalInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.PieceLength != 32768 || info.Private == nil || !*info.Private || info.Source != "test source" {
+			t.Errorf("%v first: info: piece length %v, private %v, source %q", first, info.PieceLength, info.Private, info.Source)
+		}
+		var paths []string
+		for _, f := range info.Files {
+			paths = append(paths, strings.Join(f.Path, "/"))
+		}
+		if !slices.Equal(paths, []string{"a", "b"}) {
+			t.Errorf("%v first: files %q", first, paths)
+		}
+		expectedAnnounceList := metainfo.AnnounceList{
+			{"http://a.example/announce", "udp://b.example:1337"},
+			{"wss://c.example/announce"},
+			{"https://d.example/announce"},
+		}
+		if mi.Comment != "hello" || mi.Announce != "http://a.example/announce" ||
+			!reflect.DeepEqual(mi.AnnounceList, expectedAnnounceList) ||
+			!slices.Equal(mi.UrlList, []string{"https://e.example/", "http://f.example/files/"}) {
+			t.Errorf("%v first: metainfo: %q %q %q %q", first, mi.Comment, mi.Announce, mi.AnnounceList, mi.UrlList)
+		}
+		if infoBytes != nil && !bytes.Equal(infoBytes, mi.InfoBytes) {
+			t.Errorf("%v first: info differs", first)
+		}
+		infoBytes = mi.InfoBytes
+	}
+	// The info options change the infohash.
+	plain := testUploadForm(t, testingHandler(t), [][2]string{{"name", "test"}, {"piece-length", "32768"}}, files)
+	if plain.HashInfoBytes() == metainfo.HashBytes(infoBytes) {
+		t.Fatal("infohash unchanged by options")
+	}
+}
+
+// Malformed upload forms get a structured bad request error.
+func TestUploadMalformed(t *testing.T) {
+	form := func(fields, files [][2]string) (string, string) {
+		var body bytes.Buffer
+		mw := writeStreamUploadForm(&body, fields, files)
+		return body.String(), mw.FormDataContentType()
+	}
+	valid, validType := form([][2]string{{"name", "test"}}, [][2]string{{"a", strings.Repeat("hello", 1000)}})
+	var noFilename bytes.Buffer
+	noFilenameWriter := multipart.NewWriter(&noFilename)
+	noFilenameWriter.WriteField("name", "test")
+	noFilenameWriter.WriteField("files", "hello")
+	noFilenameWriter.Close()
+	type testCase struct {
+		name, body, contentType string
+	}
+	cases := []testCase{
+		{"not multipart", "hello", "text/plain"},
+		{"no boundary", valid, "multipart/form-data"},
+		{"truncated", valid[:len(valid)/2], validType},
+		{"file without filename", noFilename.String(), noFilenameWriter.FormDataContentType()},
+	}
+	for _, c := range []struct {
+		name          string
+		fields, files [][2]string
+	}{
+		{"no name", nil, [][2]string{{"a", "hello"}}},
+		{"no files", [][2]string{{"name", "test"}}, nil},
+		{"unknown version", [][2]string{{"name", "test"}, {"version", "3"}}, [][2]string{{"a", "hello"}}},
+		{"conflicting paths", [][2]string{{"name", "test"}, {"version", "2"}}, [][2]string{{"a", "hello"}, {"a/b", "world"}}},
+		{"piece length not a power of two", [][2]string{{"name", "test"}, {"piece-length", "20000"}}, [][2]string{{"a", "hello"}}},
+		{"piece length too small", [][2]string{{"name", "test"}, {"piece-length", "8192"}}, [][2]string{{"a", "hello"}}},
+		{"invalid private", [][2]string{{"name", "test"}, {"private", "maybe"}}, [][2]string{{"a", "hello"}}},
+		{"tracker scheme", [][2]string{{"name", "test"}, {"trackers", "ftp://a.example/"}}, [][2]string{{"a", "hello"}}},
+		{"relative tracker", [][2]string{{"name", "test"}, {"trackers", "announce"}}, [][2]string{{"a", "hello"}}},
+		{"web seed scheme", [][2]string{{"name", "test"}, {"url-list", "udp://a.example/"}}, [][2]string{{"a", "hello"}}},
+		{"unknown file order", [][2]string{{"name", "test"}, {"file-order", "size"}}, [][2]string{{"a", "hello"}}},
+		{"v2 in form order", [][2]string{{"name", "test"}, {"version", "2"}, {"file-order", "form"}}, [][2]string{{"a", "hello"}}},
+		{"parent directory", [][2]string{{"name", "test"}}, [][2]string{{"../a", "hello"}}},
+		{"current directory", [][2]string{{"name", "test"}}, [][2]string{{"dir/./a", "hello"}}},
+		{"empty path component", [][2]string{{"name", "test"}}, [][2]string{{"dir//a", "hello"}}},
+		{"trailing slash", [][2]string{{"name", "test"}}, [][2]string{{"dir/", "hello"}}},
+		{"stripped to parent directory", [][2]string{{"name", "test"}, {"strip-top-directory", "1"}}, [][2]string{{"top/../a", "hello"}}},
+	} {
+		body, contentType := form(c.fields, c.files)
+		cases = append(cases, testCase{c.name, body, contentType})
+	}
+	h := testingHandler(t)
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(c.body))
+		r.Header.Set("Content-Type", c.contentType)
+		r.Header.Set("Accept", jsonContentType)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		var e Error
+		json.Unmarshal(w.Body.Bytes(), &e)
+		if w.Code != http.StatusBadRequest || e.Code != ErrorCodeBadRequest {
+			t.Errorf("%v: %v %q", c.name, w.Code, w.Body.String())
+		}
+	}
+}
+
+// Wraps the pieces of a storage, such as to fail writes to them.
+type pieceWrappingStorage struct {
+	storage.ClientImpl
+	wrap func(p metainfo.Piece, pi storage.PieceImpl) storage.PieceImpl
+}
+
+func (me pieceWrappingStorage) OpenTorrent(ctx context.Context, info *metainfo.Info, ih metainfo.Hash) (ret storage.TorrentImpl, err error) {
+	ret, err = me.ClientImpl.OpenTorrent(ctx, info, ih)
+	if piece := ret.Piece; piece != nil {
+		ret.Piece = func(p metainfo.Piece) storage.PieceImpl {
+			return me.wrap(p, piece(p))
+		}
+	}
+	if pieceWithHash := ret.PieceWithHash; pieceWithHash != nil {
+		ret.PieceWithHash = func(p metainfo.Piece, hash g.Option[[]byte]) storage.PieceImpl {
+			return me.wrap(p, pieceWithHash(p, hash))
+		}
+	}
+	return
+}
+
+type failingPiece struct {
+	storage.PieceImpl
+}
+
+func (failingPiece) WriteAt([]byte, int64) (int, error) {
+	return 0, errors.New("disk on fire")
+}
+
+// A failure to store an upload is reported, and leaves no complete pieces or metainfo behind.
+func TestUploadStorageFailure(t *testing.T) {
+	files := map[string]string{"a": strings.Repeat("hello", 10000)}
+	mi := testUploadMetainfo(t, testingHandler(t), map[string]string{"name": "test"}, files)
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := testingHandler(t)
+	storageImpl := storage.NewFileOpts(storage.NewFileClientOpts{
+		ClientBaseDir:   t.TempDir(),
+		PieceCompletion: storage.NewMapPieceCompletion(),
+	})
+	h.Storage = storage.NewClient(pieceWrappingStorage{storageImpl, func(p metainfo.Piece, pi storage.PieceImpl) storage.PieceImpl {
+		if p.Index() == 2 {
+			return failingPiece{pi}
+		}
+		return pi
+	}})
+	r := newUploadRequest(map[string]string{"name": "test"}, files)
+	r.Header.Set("Accept", jsonContentType)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var e Error
+	json.Unmarshal(w.Body.Bytes(), &e)
+	if w.Code != http.StatusInternalServerError || e.Code != ErrorCodeInternal || !strings.Contains(e.Message, "disk on fire") {
+		t.Fatalf("%v %q", w.Code, w.Body.String())
+	}
+	ts, err := storage.NewClient(storageImpl).OpenTorrent(context.Background(), &info, mi.HashInfoBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range info.NumPieces() {
+		if c := ts.Piece(info.Piece(i)).Completion(); c.Complete {
+			t.Errorf("piece %v is complete", i)
+		}
+	}
+	ts.Close()
+	if saved, _ := h.cachedMetaInfo(mi.HashInfoBytes()); saved != nil {
+		t.Errorf("metainfo saved")
+	}
+}
+
+// Clients that accept JSON get the infohash, magnet link and data URLs instead of the metainfo.
+func TestUploadJson(t *testing.T) {
+	files := map[string]string{"a": "hello", "dir/b": "world"}
+	for _, version := range []string{uploadVersionV1, uploadVersionV2, uploadVersionHybrid} {
+		h := testingHandler(t)
+		fields := map[string]string{"name": "test", "version": version, "piece-length": "16384"}
+		// The infohash doesn't depend on the response type.
+		ih, _ := metainfoCanonicalInfohash(testUploadMetainfo(t, testingHandler(t), fields, files))
+		r := newUploadRequest(fields, files)
+		r.Header.Set("Accept", jsonContentType)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != jsonContentType {
+			t.Fatalf("%v: %v %q", version, w.Code, w.Body.String())
+		}
+		var res uploadResultJson
+		err := json.Unmarshal(w.Body.Bytes(), &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Infohash != ih || res.Name != "test" || res.Length != 10 || len(res.Files) != 2 ||
+			!strings.HasPrefix(res.Magnet, "magnet:?") || !strings.Contains(res.Magnet, ih) ||
+			(version == uploadVersionV1) != (res.InfohashV2 == "") {
+			t.Fatalf("%v: %+v", version, res)
+		}
+		// Only v1 files aren't padded to piece boundaries.
+		if (version == uploadVersionV1) != (res.DataUrl != "") {
+			t.Errorf("%v: data url %q", version, res.DataUrl)
+		}
+		if res.DataUrl != "" {
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, res.DataUrl, nil))
+			if w.Body.String() != "helloworld" {
+				t.Errorf("%v: %v: %v %q", version, res.DataUrl, w.Code, w.Body.String())
+			}
+		}
+		for _, f := range res.Files {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, f.DataUrl, nil))
+			if w.Body.String() != files[f.Path] || f.Length != int64(len(files[f.Path])) {
+				t.Errorf("%v: %+v: %q", version, f, w.Body.String())
+			}
+		}
+	}
+}
+
+// Fields after the files of a buffered upload still apply, as the spooled files are hashed again,
+// and the spool is removed afterwards.
+func TestUploadFieldsAfterFiles(t *testing.T) {
+	files := [][2]string{{"b", strings.Repeat("hello", 10000)}, {"a", "world"}}
+	fields := [][2]string{{"name", "test"}, {"version", uploadVersionHybrid}, {"piece-length", "16384"}}
+	h := testingHandler(t)
+	expected := testUploadForm(t, h, fields, files)
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("name", "test")
+	for _, f := range files {
+		fw, _ := mw.CreateFormFile("files", f[0])
+		io.WriteString(fw, f[1])
+	}
+	mw.WriteField("version", uploadVersionHybrid)
+	mw.WriteField("piece-length", "16384")
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	mi, err := metainfo.Load(w.Body)
+	if err != nil {
+		t.Fatalf("%v: %v", w.Code, err)
+	}
+	if !bytes.Equal(mi.InfoBytes, expected.InfoBytes) {
+		t.Fatalf("info differs:\n%q\n%q", mi.InfoBytes, expected.InfoBytes)
+	}
+	entries, err := os.ReadDir(h.UploadSpoolDir)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("spool: %v %v", entries, err)
+	}
+}
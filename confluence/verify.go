@@ -0,0 +1,143 @@
+package confluence
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/anacrolix/missinggo/v2/httptoo"
+)
+
+// The result of verifying a torrent's data.
+type verifyResultJson struct {
+	// The pieces in the range verified.
+	Pieces int `json:"pieces"`
+	// The complete pieces that were hashed.
+	Verified int `json:"verified"`
+	// Pieces that failed, and are now incomplete.
+	Bad []int `json:"bad"`
+	// Pieces that weren't complete, so there was nothing to verify.
+	Incomplete int `json:"incomplete"`
+}
+
+// Sent as each piece is verified.
+type verifyProgressJson struct {
+	Piece    int  `json:"piece"`
+	Ok       bool `json:"ok"`
+	Verified int  `json:"verified"`
+	Bad      int  `json:"bad"`
+	Pieces   int  `json:"pieces"`
+}
+
+// Hashes the complete pieces of the torrent, or those of a file or piece range, from storage.
+// Pieces that don't match are marked incomplete by the Client, so they're fetched again when next
+// read. Clients that accept text/event-stream get a progress event per piece verified, and then a
+// summary event, otherwise the summary is the response.
+func verifyHandler(w http.ResponseWriter, r *TorrentRequest) {
+	if !waitForTorrentInfo(w, r) {
+		return
+	}
+	t := r.Torrent
+	begin, end := 0, t.NumPieces()
+	if p := r.URL.Query().Get(filePathQueryKey); p != "" {
+		f := torrentFileByPath(t, p)
+		if f == nil {
+			r.error(w, http.StatusNotFound, ErrorCodeFileNotFound, "file not found")
+			return
+		}
+		begin, end = f.BeginPieceIndex(), f.EndPieceIndex()
+	}
+	for _, bound := range []struct {
+		key string
+		ptr *int
+	}{
+		{"begin", &begin},
+		{"end", &end},
+	} {
+		s := r.URL.Query().Get(bound.key)
+		if s == "" {
+			continue
+		}
+		i, err := strconv.Atoi(s)
+		if err != nil || i < begin || i > end {
+			r.error(w, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("%v %q isn't a piece index in range [%v, %v]", bound.key, s, begin, end))
+			return
+		}
+		*bound.ptr = i
+	}
+	if begin > end {
+		r.error(w, http.StatusBadRequest, ErrorCodeBadRequest, "begin is after end")
+		return
+	}
+	var events *eventStream
+	if acceptsMediaType(r.Request, eventStreamContentType) {
+		events = newEventStream(w)
+	}
+	var mu sync.Mutex
+	ret := verifyResultJson{Pieces: end - begin, Bad: []int{}}
+	err := parallelFor(r.Context(), end-begin, func(i int) error {
+		i += begin
+		piece := t.Piece(i)
+		if !piece.State().Complete {
+			mu.Lock()
+			ret.Incomplete++
+			mu.Unlock()
+			return nil
+		}
+		// The Client marks the piece incomplete in storage if the hash fails.
+		piece.VerifyData()
+		ok := piece.State().Complete
+		mu.Lock()
+		defer mu.Unlock()
+		ret.Verified++
+		if !ok {
+			ret.Bad = append(ret.Bad, i)
+		}
+		events.send("progress", verifyProgressJson{
+			Piece:    i,
+			Ok:       ok,
+			Verified: ret.Verified,
+			Bad:      len(ret.Bad),
+			Pieces:   ret.Pieces,
+		})
+		return nil
+	})
+	if err != nil {
+		if events == nil {
+			r.error(w, httptoo.StatusClientCancelledRequest, ErrorCodeRequestCanceled, "request canceled")
+		}
+		return
+	}
+	slices.Sort(ret.Bad)
+	if events != nil {
+		events.send("summary", ret)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	json.NewEncoder(w).Encode(ret)
+}
+
+// Writes server-sent events with JSON data, flushing each. A nil eventStream discards events.
+type eventStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func newEventStream(w http.ResponseWriter) *eventStream {
+	w.Header().Set("Content-Type", eventStreamContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	return &eventStream{w: w, rc: http.NewResponseController(w)}
+}
+
+func (me *eventStream) send(event string, data any) {
+	if me == nil {
+		return
+	}
+	b, _ := json.Marshal(data)
+	fmt.Fprintf(me.w, "event: %s\ndata: %s\n\n", event, b)
+	me.rc.Flush()
+}
@@ -0,0 +1,95 @@
+package confluence
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testVerify(t *testing.T, h http.Handler, query url.Values) verifyResultJson {
+	return testJsonRequest[verifyResultJson](t, h, httptest.NewRequest(
+		http.MethodPost, "/verify?"+query.Encode(), nil), http.StatusOK)
+}
+
+func TestVerify(t *testing.T) {
+	h := testingHandler(t)
+	// Pieces 0 to 2 are in a, and 2 and 3 in b.
+	mi := testUploadMetainfo(t, h, map[string]string{
+		"name":         "test",
+		"piece-length": "16384",
+	}, map[string]string{
+		"a": strings.Repeat("a", 40000),
+		"b": strings.Repeat("b", 20000),
+	})
+	ih := mi.HashInfoBytes()
+	all := url.Values{"ih": {ih.HexString()}}
+	res := testVerify(t, h, all)
+	if !reflect.DeepEqual(res, verifyResultJson{Pieces: 4, Verified: 4, Bad: []int{}}) {
+		t.Fatalf("%+v", res)
+	}
+	tor, _, release := h.GetTorrent(ih)
+	defer release()
+	_, err := tor.Piece(1).Storage().WriteAt([]byte("x"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = testVerify(t, h, url.Values{"ih": {ih.HexString()}, "path": {"b"}})
+	if !reflect.DeepEqual(res, verifyResultJson{Pieces: 2, Verified: 2, Bad: []int{}}) {
+		t.Fatalf("verifying b: %+v", res)
+	}
+	// Progress is streamed as events.
+	r := httptest.NewRequest(http.MethodPost, "/verify?"+url.Values{
+		"ih":    {ih.HexString()},
+		"begin": {"1"},
+		"end":   {"2"},
+	}.Encode(), nil)
+	r.Header.Set("Accept", "text/event-stream")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("%v %q", w.Code, w.Body.String())
+	}
+	expected := `event: progress
+data: {"piece":1,"ok":false,"verified":1,"bad":1,"pieces":1}
+
+event: summary
+data: {"pieces":1,"verified":1,"bad":[1],"incomplete":0}
+
+`
+	if w.Body.String() != expected {
+		t.Fatalf("events: %q", w.Body.String())
+	}
+	// The bad piece is incomplete now.
+	res = testVerify(t, h, all)
+	if !reflect.DeepEqual(res, verifyResultJson{Pieces: 4, Verified: 3, Bad: []int{}, Incomplete: 1}) {
+		t.Fatalf("verifying again: %+v", res)
+	}
+	if tor.Piece(1).State().Complete {
+		t.Fatal("bad piece is complete")
+	}
+}
+
+func TestVerifyInvalidRange(t *testing.T) {
+	h := testingHandler(t)
+	mi := testUploadMetainfo(t, h, map[string]string{"name": "test"}, map[string]string{"a": "hello"})
+	ih := mi.HashInfoBytes().HexString()
+	for _, query := range []url.Values{
+		{"ih": {ih}, "begin": {"2"}},
+		{"ih": {ih}, "end": {"x"}},
+		{"ih": {ih}, "begin": {"1"}, "end": {"0"}},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/verify?"+query.Encode(), nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: %v %q", query, w.Code, w.Body.String())
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/verify?"+url.Values{"ih": {ih}, "path": {"c"}}.Encode(), nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("missing file: %v %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,30 @@
+package confluence
+
+import (
+	"net/http"
+	"strings"
+)
+
+const webseedPathWildcard = "path"
+
+// Serves files in the layout web seeding clients expect (BEP 19) for a web seed URL of
+// "/webseed/<infohash>/": the torrent name, followed by the file path for multi-file torrents.
+func webseedHandler(w http.ResponseWriter, r *TorrentRequest) {
+	if !waitForTorrentInfo(w, r) {
+		return
+	}
+	info := r.Torrent.Info()
+	name, filePath, _ := strings.Cut(r.PathValue(webseedPathWildcard), "/")
+	if name != info.BestName() && name != info.Name {
+		r.error(w, http.StatusNotFound, ErrorCodeFileNotFound, "torrent name doesn't match")
+		return
+	}
+	for _, f := range r.Torrent.Files() {
+		fi := f.FileInfo()
+		if strings.Join(fi.BestPath(), "/") == filePath {
+			serveTorrentFile(w, r.Request, r.Torrent, f, f.DisplayPath())
+			return
+		}
+	}
+	r.error(w, http.StatusNotFound, ErrorCodeFileNotFound, "file not found")
+}
@@ -0,0 +1,39 @@
+package confluence
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent/webseed"
+)
+
+// Requests files from upload web seeds as BEP 19 clients would.
+func TestWebseedUploads(t *testing.T) {
+	files := map[string]string{
+		"a b+c": "hello",
+		"dir/d": strings.Repeat("world", 10000),
+	}
+	for _, version := range []string{uploadVersionV1, uploadVersionV2, uploadVersionHybrid} {
+		h := testingHandler(t)
+		h.EnrichUploads = true
+		mi := testUploadMetainfo(t, h, map[string]string{"name": "up load", "version": version}, files)
+		if len(mi.UrlList) != 1 {
+			t.Fatalf("version %v: web seeds %q", version, mi.UrlList)
+		}
+		for path, data := range files {
+			target := mi.UrlList[0] + webseed.EscapePath(append([]string{"up load"}, strings.Split(path, "/")...))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+			if w.Code != http.StatusOK || w.Body.String() != data {
+				t.Errorf("version %v: %v: %v with %v bytes", version, target, w.Code, w.Body.Len())
+			}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, mi.UrlList[0]+"wrong/dir/d", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("version %v: wrong torrent name: %v", version, w.Code)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package confluence
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/webseed"
+)
+
+// Counts what a torrent has fetched from one of its web seeds (BEP 19).
+type webseedStats struct {
+	requests     atomic.Int64
+	bytesFetched atomic.Int64
+	errors       atomic.Int64
+	mu           sync.Mutex
+	lastError    string
+}
+
+func (me *webseedStats) recordError(err error) {
+	me.errors.Add(1)
+	me.mu.Lock()
+	me.lastError = err.Error()
+	me.mu.Unlock()
+}
+
+// The state of a web seed of a torrent, as reported in the torrent JSON.
+type webseedStatus struct {
+	Url string `json:"url"`
+	// Whether the torrent Client is using the web seed. Web seeds may be disabled in the Client.
+	Active       bool   `json:"active"`
+	Requests     int64  `json:"requests"`
+	BytesFetched int64  `json:"bytesFetched"`
+	Errors       int64  `json:"errors"`
+	LastError    string `json:"lastError,omitempty"`
+}
+
+// Counts requests and response errors for a web seed.
+type webseedTransport struct {
+	base  http.RoundTripper
+	stats *webseedStats
+}
+
+func (me webseedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	me.stats.requests.Add(1)
+	resp, err := me.base.RoundTrip(r)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			me.stats.recordError(err)
+		}
+		return resp, err
+	}
+	if resp.StatusCode >= 400 {
+		me.stats.recordError(fmt.Errorf("%v: unexpected response status %q", r.URL, resp.Status))
+	}
+	return resp, nil
+}
+
+type countingReader struct {
+	r     io.Reader
+	count *atomic.Int64
+}
+
+func (me countingReader) Read(b []byte) (n int, err error) {
+	n, err = me.r.Read(b)
+	me.count.Add(int64(n))
+	return
+}
+
+func webseedStatsOpt(stats *webseedStats) torrent.AddWebSeedsOpt {
+	return func(c *webseed.Client) {
+		hc := *c.HttpClient
+		if hc.Transport == nil {
+			hc.Transport = http.DefaultTransport
+		}
+		hc.Transport = webseedTransport{hc.Transport, stats}
+		c.HttpClient = &hc
+		wrapped := c.ResponseBodyWrapper
+		c.ResponseBodyWrapper = func(r io.Reader) io.Reader {
+			if wrapped != nil {
+				r = wrapped(r)
+			}
+			return countingReader{r, &stats.bytesFetched}
+		}
+	}
+}
+
+// Whether web seeds can be fetched from the URL, which must be HTTP or HTTPS, and have a host in
+// WebseedHosts.
+func (h *Handler) webseedAllowed(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return false
+	}
+	for _, host := range h.WebseedHosts {
+		if host == "*" || strings.EqualFold(host, u.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds web seeds to the torrent, recording what's fetched from them for the torrent JSON. Web seeds
+// in specs merged by the Handler are added this way, but OnNewTorrent should use this directly for
+// them to be tracked. Web seeds the torrent already has, or that WebseedHosts doesn't allow, are
+// ignored.
+func (h *Handler) AddWebseeds(t *torrent.Torrent, urls []string) {
+	h.webseedsMu.Lock()
+	defer h.webseedsMu.Unlock()
+	byUrl, ok := h.webseeds[t]
+	if !ok {
+		if h.webseeds == nil {
+			h.webseeds = make(map[*torrent.Torrent]map[string]*webseedStats)
+		}
+		byUrl = make(map[string]*webseedStats)
+		h.webseeds[t] = byUrl
+		go func() {
+			<-t.Closed()
+			h.webseedsMu.Lock()
+			delete(h.webseeds, t)
+			h.webseedsMu.Unlock()
+		}()
+	}
+	for _, u := range urls {
+		if _, ok := byUrl[u]; ok {
+			continue
+		}
+		if parsed, err := url.Parse(u); err != nil || !h.webseedAllowed(parsed) {
+			continue
+		}
+		stats := new(webseedStats)
+		byUrl[u] = stats
+		t.AddWebSeeds([]string{u}, webseedStatsOpt(stats))
+	}
+}
+
+// The status of web seeds added with AddWebseeds, ordered by URL.
+func (h *Handler) webseedStatuses(t *torrent.Torrent) []webseedStatus {
+	active := t.Metainfo().UrlList
+	h.webseedsMu.Lock()
+	defer h.webseedsMu.Unlock()
+	ret := make([]webseedStatus, 0, len(h.webseeds[t]))
+	for u, stats := range h.webseeds[t] {
+		stats.mu.Lock()
+		lastError := stats.lastError
+		stats.mu.Unlock()
+		ret = append(ret, webseedStatus{
+			Url:          u,
+			Active:       slices.Contains(active, u),
+			Requests:     stats.requests.Load(),
+			BytesFetched: stats.bytesFetched.Load(),
+			Errors:       stats.errors.Load(),
+			LastError:    lastError,
+		})
+	}
+	slices.SortFunc(ret, func(a, b webseedStatus) int {
+		return strings.Compare(a.Url, b.Url)
+	})
+	return ret
+}
+
+// Adds the web seed URLs in the body, one per line, and responds with the status of the torrent's
+// web seeds.
+func (h *Handler) webseedsPostHandler(w http.ResponseWriter, r *TorrentRequest) {
+	var urls []string
+	s := bufio.NewScanner(r.Body)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		u, err := url.Parse(line)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			r.error(w, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("invalid web seed url %q", line))
+			return
+		}
+		if !h.webseedAllowed(u) {
+			r.error(w, http.StatusForbidden, ErrorCodeForbidden, fmt.Sprintf("web seed host %q isn't allowed", u.Hostname()))
+			return
+		}
+		urls = append(urls, line)
+	}
+	if err := s.Err(); err != nil {
+		r.error(w, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("reading body: %v", err))
+		return
+	}
+	h.AddWebseeds(r.Torrent, urls)
+	h.saveTorrentFile(r.Torrent)
+	w.Header().Set("Content-Type", jsonContentType)
+	json.NewEncoder(w).Encode(h.webseedStatuses(r.Torrent))
+}
@@ -0,0 +1,171 @@
+package confluence
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+type testTorrentJson struct {
+	Webseeds []webseedStatus `json:"webseeds"`
+}
+
+func getTorrentJson(t *testing.T, h http.Handler, ih metainfo.Hash) testTorrentJson {
+	return testJsonRequest[testTorrentJson](t, h, httptest.NewRequest(http.MethodGet, "/torrent?ih="+ih.HexString(), nil), http.StatusOK)
+}
+
+func postTestMetainfo(t *testing.T, h http.Handler, mi *metainfo.MetaInfo) {
+	var body bytes.Buffer
+	mi.Write(&body)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/metainfo", &body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("posting metainfo: %v %q", w.Code, w.Body.String())
+	}
+}
+
+func postWebseeds(h http.Handler, ih metainfo.Hash, urls ...string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(
+		http.MethodPost,
+		"/webseeds?ih="+ih.HexString(),
+		strings.NewReader(strings.Join(urls, "\n"))))
+	return w
+}
+
+// Fetches torrent data from another Handler's /webseed route, with no peers, given the web seed in
+// each of the supported ways.
+func TestFetchFromWebseeds(t *testing.T) {
+	files := map[string]string{
+		"a":     strings.Repeat("hello", 10000),
+		"dir/b": "world",
+	}
+	seed := testingHandler(t)
+	mi := testUploadMetainfo(t, seed, map[string]string{"name": "test"}, files)
+	ih := mi.HashInfoBytes()
+	srv := httptest.NewServer(seed)
+	defer srv.Close()
+	ws := srv.URL + "/webseed/" + ih.HexString() + "/"
+	for _, source := range []string{"url-list", "magnet", "post"} {
+		t.Run(source, func(t *testing.T) {
+			h := testingHandler(t)
+			h.WebseedHosts = []string{"127.0.0.1"}
+			mi := *mi
+			if source == "url-list" {
+				mi.UrlList = []string{ws}
+			}
+			postTestMetainfo(t, h, &mi)
+			var r *http.Request
+			switch source {
+			case "magnet":
+				r = magnetRequest("/data", "magnet:?xt=urn:btih:"+ih.HexString()+"&ws="+url.QueryEscape(ws))
+				r.URL.RawQuery += "&path=a"
+			case "post":
+				w := postWebseeds(h, ih, ws)
+				if w.Code != http.StatusOK {
+					t.Fatalf("posting web seeds: %v %q", w.Code, w.Body.String())
+				}
+				fallthrough
+			default:
+				r = httptest.NewRequest(http.MethodGet, "/data?ih="+ih.HexString()+"&path=a", nil)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r.WithContext(ctx))
+			if w.Code != http.StatusOK || w.Body.String() != files["a"] {
+				t.Fatalf("data: %v with %v bytes", w.Code, w.Body.Len())
+			}
+			webseeds := getTorrentJson(t, h, ih).Webseeds
+			if len(webseeds) != 1 {
+				t.Fatalf("web seeds: %+v", webseeds)
+			}
+			s := webseeds[0]
+			if s.Url != ws || !s.Active || s.Requests == 0 || s.BytesFetched < int64(len(files["a"])) || s.Errors != 0 {
+				t.Fatalf("web seed status: %+v", s)
+			}
+		})
+	}
+}
+
+func TestWebseedErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	h := testingHandler(t)
+	ih := testPostSingleFileMetainfo(t, h, "file", "hello")
+	w := postWebseeds(h, ih, "ftp://example.com/")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid url: %v", w.Code)
+	}
+	h.WebseedHosts = []string{"*"}
+	w = postWebseeds(h, ih, srv.URL+"/")
+	if w.Code != http.StatusOK {
+		t.Fatalf("posting web seeds: %v %q", w.Code, w.Body.String())
+	}
+	// Wanting the data causes the web seed to be tried.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/data?ih="+ih.HexString(), nil).WithContext(ctx))
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		webseeds := getTorrentJson(t, h, ih).Webseeds
+		if len(webseeds) != 1 {
+			t.Fatalf("web seeds: %+v", webseeds)
+		}
+		s := webseeds[0]
+		if s.Errors != 0 {
+			if !strings.Contains(s.LastError, "500") {
+				t.Fatalf("web seed status: %+v", s)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no web seed errors: %+v", s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Web seeds on hosts that aren't allowed are refused when posted, and ignored from magnet links and
+// url-lists.
+func TestWebseedHostsNotAllowed(t *testing.T) {
+	const ws = "http://127.0.0.1:1/"
+	h := testingHandler(t)
+	h.WebseedHosts = []string{"seed.example"}
+	mi := testUploadMetainfo(t, testingHandler(t), map[string]string{"name": "test"}, map[string]string{"a": "a"})
+	ih := mi.HashInfoBytes()
+	mi.UrlList = []string{ws, "ftp://seed.example/"}
+	postTestMetainfo(t, h, mi)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, magnetRequest("/torrent", "magnet:?xt=urn:btih:"+ih.HexString()+"&ws="+url.QueryEscape(ws)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("magnet: %v %q", w.Code, w.Body.String())
+	}
+	w = postWebseeds(h, ih, ws)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("posting web seeds: %v %q", w.Code, w.Body.String())
+	}
+	if webseeds := getTorrentJson(t, h, ih).Webseeds; len(webseeds) != 0 {
+		t.Fatalf("web seeds: %+v", webseeds)
+	}
+	w = postWebseeds(h, ih, "https://SEED.example/")
+	if webseeds := getTorrentJson(t, h, ih).Webseeds; w.Code != http.StatusOK || len(webseeds) != 1 {
+		t.Fatalf("allowed web seed: %v %+v", w.Code, webseeds)
+	}
+}
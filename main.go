@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
@@ -10,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/anacrolix/dht/v2"
@@ -63,6 +66,22 @@ var flags = struct {
 	ImplicitTracker  []string `help:"Trackers to be used for all torrents"`
 	OverrideTrackers bool     `help:"Only use implied trackers"`
 	Pex              bool
+	DisableWebseeds  bool `help:"Don't fetch data from web seeds"`
+	// Web seeds come from clients, so fetching them could reach anything the server can.
+	WebseedHost []string `help:"Hosts web seeds can be fetched from, or * for any"`
+	// Each file in the directory holds a hex ed25519 private key seed, named by the key name.
+	Bep44KeyDir        string        `help:"Directory of named keys for signing BEP 44 puts"`
+	Bep44CacheDuration time.Duration `help:"How long to cache BEP 44 gets"`
+	// Mutable torrents are looked up on every request otherwise.
+	MutableTorrentCacheDuration time.Duration `help:"How long to cache the infohashes of mutable torrents"`
+	// Torrents created from these with POST /admin/seedDir are seeded from the files in place. The
+	// route is only served if any are given.
+	SeedDir   []string `help:"Directories torrents can be created from in place, with the unauthenticated POST /admin/seedDir"`
+	ImportDir []string `help:"Directories torrent data can be imported from"`
+
+	UploadSessionDir    string        `help:"Directory resumable upload sessions are kept in, empty to disable them"`
+	UploadSessionExpiry time.Duration `help:"How long upload sessions are kept without chunks being written"`
+	UploadSpoolDir      string        `help:"Directory uploads are buffered in until they're hashed"`
 
 	SqliteStorage           *string
 	InitSqliteStorageSchema bool
@@ -83,6 +102,11 @@ var flags = struct {
 	Pex:            true,
 	TorrentAddr:    ":42069",
 
+	Bep44CacheDuration:          time.Minute,
+	MutableTorrentCacheDuration: time.Minute,
+	UploadSessionExpiry:         24 * time.Hour,
+	UploadSpoolDir:              "upload-spool",
+
 	InitSqliteStorageSchema: true,
 }
 
@@ -135,6 +159,7 @@ func newTorrentClient(
 	cfg.SetListenAddr(flags.TorrentAddr)
 	cfg.Callbacks = callbacks
 	cfg.DisablePEX = !flags.Pex
+	cfg.DisableWebseeds = flags.DisableWebseeds
 
 	if flags.AnalyzePeerUploadOrder {
 		var pieceOrdering analysis.PeerUploadOrder
@@ -225,9 +250,37 @@ func newClientStorage(squirrelCache *squirrel.Cache) (
 	return storage.NewResourcePieces(prov), func(torrent.InfoHash) {}, close
 }
 
+func loadBep44Keys(dir string) (map[string]ed25519.PrivateKey, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]ed25519.PrivateKey, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("key %q isn't a hex ed25519 seed", e.Name())
+		}
+		keys[e.Name()] = ed25519.NewKeyFromSeed(seed)
+	}
+	return keys, nil
+}
+
 func main() {
 	statsviz.RegisterDefault()
 	log.SetFlags(log.Flags() | log.Lshortfile)
+	if len(os.Args) > 1 && os.Args[1] == "seed-dir" {
+		tagflag.ParseArgs(&seedDirFlags, os.Args[2:], tagflag.Program(os.Args[0]+" seed-dir"))
+		app.RunContext(seedDirMain)
+		return
+	}
 	tagflag.Parse(&flags)
 	app.RunContext(mainErr)
 }
@@ -291,23 +344,19 @@ func mainErr(ctx context.Context) error {
 	}
 	defer l.Close()
 	log.Printf("serving http at %s", l.Addr())
+	applyTrackerPolicy := func(spec *torrent.TorrentSpec) {
+		if flags.OverrideTrackers {
+			spec.Trackers = nil
+		}
+	}
 	ch := confluence.Handler{
-		TC:           cl,
-		TorrentGrace: flags.TorrentGrace,
-		OnNewTorrent: func(t *torrent.Torrent, mi *metainfo.MetaInfo) {
-			var spec *torrent.TorrentSpec
-			if mi != nil {
-				spec, _ = torrent.TorrentSpecFromMetaInfoErr(mi)
-			} else {
-				spec = new(torrent.TorrentSpec)
-			}
-			if flags.OverrideTrackers {
-				spec.Trackers = nil
-			}
-			spec.Trackers = append(spec.Trackers, flags.ImplicitTracker)
-			t.MergeSpec(spec)
-		},
-		MetainfoStorage: squirrelCache,
+		TC:                          cl,
+		TorrentGrace:                flags.TorrentGrace,
+		Bep44CacheDuration:          flags.Bep44CacheDuration,
+		MutableTorrentCacheDuration: flags.MutableTorrentCacheDuration,
+		ModifyTorrentSpec:           applyTrackerPolicy,
+		ImplicitTrackers:            flags.ImplicitTracker,
+		MetainfoStorage:             squirrelCache,
 		ModifyUploadMetainfo: func(mi *metainfo.MetaInfo) {
 			mi.AnnounceList = append(mi.AnnounceList, flags.ImplicitTracker)
 			for _, ip := range cl.PublicIPs() {
@@ -316,7 +365,31 @@ func mainErr(ctx context.Context) error {
 					strconv.FormatInt(int64(cl.LocalPort()), 10))))
 			}
 		},
-		Storage: storage.NewClient(clientStorageImpl),
+		Storage:             storage.NewClient(clientStorageImpl),
+		SeedDirs:            flags.SeedDir,
+		ImportDirs:          flags.ImportDir,
+		UploadSessionDir:    flags.UploadSessionDir,
+		UploadSessionExpiry: flags.UploadSessionExpiry,
+		UploadSpoolDir:      flags.UploadSpoolDir,
+		WebseedHosts:        flags.WebseedHost,
+	}
+	if len(flags.SeedDir) != 0 {
+		ch.ExtraRoutes = append(ch.ExtraRoutes, ch.SeedDirRoute())
+	}
+	ch.OnNewTorrent = func(t *torrent.Torrent, mi *metainfo.MetaInfo) {
+		var spec *torrent.TorrentSpec
+		if mi != nil {
+			spec, _ = torrent.TorrentSpecFromMetaInfoErr(mi)
+		} else {
+			spec = new(torrent.TorrentSpec)
+		}
+		applyTrackerPolicy(spec)
+		spec.Trackers = append(spec.Trackers, flags.ImplicitTracker)
+		// Added separately so that what's fetched from them is tracked.
+		webseeds := spec.Webseeds
+		spec.Webseeds = nil
+		t.MergeSpec(spec)
+		ch.AddWebseeds(t, webseeds)
 	}
 	if flags.ExpireTorrents {
 		ch.OnTorrentGrace = func(t *torrent.Torrent) {
@@ -328,6 +401,12 @@ func mainErr(ctx context.Context) error {
 	for _, s := range cl.DhtServers() {
 		ch.DhtServers = append(ch.DhtServers, s.(torrent.AnacrolixDhtServerWrapper).Server)
 	}
+	if flags.Bep44KeyDir != "" {
+		ch.Bep44Keys, err = loadBep44Keys(flags.Bep44KeyDir)
+		if err != nil {
+			return fmt.Errorf("loading bep44 keys: %w", err)
+		}
+	}
 	var h http.Handler = &ch
 	if flags.DebugOnMain {
 		h = func() http.Handler {
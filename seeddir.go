@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/anacrolix/tagflag"
+
+	"github.com/anacrolix/confluence/confluence/client"
+)
+
+// Flags for the seed-dir subcommand, which has a running confluence create a torrent from a
+// directory on its host and seed it in place.
+var seedDirFlags = struct {
+	Addr        string        `help:"HTTP address of the confluence instance"`
+	Version     string        `help:"Torrent version: 1, 2 or hybrid"`
+	PieceLength tagflag.Bytes `help:"Piece length, chosen from the total length if not given"`
+	Private     bool          `help:"Mark the torrent private"`
+	Out         string        `help:"File to write the metainfo to"`
+	tagflag.StartPos
+	Dir string `help:"Directory within one of the instance's -seedDir"`
+}{
+	Addr: "localhost:8080",
+}
+
+func seedDirMain(ctx context.Context) error {
+	dir, err := filepath.Abs(seedDirFlags.Dir)
+	if err != nil {
+		return err
+	}
+	options := url.Values{}
+	if seedDirFlags.Version != "" {
+		options.Set("version", seedDirFlags.Version)
+	}
+	if seedDirFlags.PieceLength != 0 {
+		options.Set("piece-length", strconv.FormatInt(seedDirFlags.PieceLength.Int64(), 10))
+	}
+	if seedDirFlags.Private {
+		options.Set("private", "1")
+	}
+	c := client.Client{Address: "http://" + seedDirFlags.Addr}
+	mi, err := c.SeedDir(ctx, dir, options)
+	if err != nil {
+		return err
+	}
+	if seedDirFlags.Out != "" {
+		f, err := os.Create(seedDirFlags.Out)
+		if err != nil {
+			return err
+		}
+		err = mi.Write(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("writing metainfo: %w", err)
+		}
+	}
+	m, err := mi.MagnetV2()
+	if err != nil {
+		return err
+	}
+	fmt.Println(m.String())
+	return nil
+}